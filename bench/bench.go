@@ -0,0 +1,267 @@
+// Package bench drives processes against an in-memory entity and measures
+// how fast their writes are acked, to size the batching options from data
+package bench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qwertyqq2/entity/entity"
+	"github.com/qwertyqq2/entity/process"
+)
+
+const sampleInterval = 10 * time.Millisecond
+
+var ErrTimeout = errors.New("not all writes are acked in time")
+
+// Distribution of sizes, see ParseDist
+type Dist struct {
+	Min, Max int
+	// mean of an exponential distribution, Min and Max bound it when set
+	Mean int
+}
+
+// ParseDist parses "N" for a fixed size, "MIN-MAX" for a uniform one and "exp:MEAN" for an exponential one
+func ParseDist(s string) (Dist, error) {
+	if strings.HasPrefix(s, "exp:") {
+		mean := strings.TrimPrefix(s, "exp:")
+		n, err := strconv.Atoi(mean)
+		if err != nil || n <= 0 {
+			return Dist{}, fmt.Errorf("bad mean %q", mean)
+		}
+		return Dist{Mean: n}, nil
+	}
+	if lo, hi, ok := strings.Cut(s, "-"); ok {
+		min, err1 := strconv.Atoi(lo)
+		max, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || min < 0 || max < min {
+			return Dist{}, fmt.Errorf("bad range %q", s)
+		}
+		return Dist{Min: min, Max: max}, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return Dist{}, fmt.Errorf("bad size %q", s)
+	}
+	return Dist{Min: n, Max: n}, nil
+}
+
+func (d Dist) String() string {
+	switch {
+	case d.Mean > 0:
+		return fmt.Sprintf("exp:%d", d.Mean)
+	case d.Min == d.Max:
+		return strconv.Itoa(d.Min)
+	default:
+		return fmt.Sprintf("%d-%d", d.Min, d.Max)
+	}
+}
+
+func (d Dist) sample(rnd *rand.Rand) int {
+	if d.Mean > 0 {
+		n := int(rnd.ExpFloat64() * float64(d.Mean))
+		if n < d.Min {
+			n = d.Min
+		}
+		if d.Max > 0 && n > d.Max {
+			n = d.Max
+		}
+		return n
+	}
+	if d.Max <= d.Min {
+		return d.Min
+	}
+	return d.Min + rnd.Intn(d.Max-d.Min+1)
+}
+
+type Config struct {
+	// Number of processes
+	Procs int
+	// Writes of all processes together
+	Writes    int
+	KeySize   Dist
+	ValueSize Dist
+	// Options of every process
+	Options []process.Option
+	// How long to wait for the acks, a minute if zero
+	Timeout time.Duration
+	Seed    int64
+}
+
+type Result struct {
+	Writes  int
+	Acked   int
+	Elapsed time.Duration
+	// Acked writes per second
+	Throughput float64
+
+	// Time from Add to the write applied by the entity
+	P50, P99, Max time.Duration
+
+	Sent   uint64
+	Resent uint64
+	Failed uint64
+
+	// Entries queued, pending and in flight in all processes
+	MaxQueueDepth int
+	AvgQueueDepth float64
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("writes %d, acked %d, elapsed %v, %.0f writes/s\n"+
+		"ack latency p50 %v, p99 %v, max %v\n"+
+		"sent %d, resent %d, failed %d\n"+
+		"queue depth max %d, avg %.1f",
+		r.Writes, r.Acked, r.Elapsed.Round(time.Millisecond), r.Throughput,
+		r.P50, r.P99, r.Max,
+		r.Sent, r.Resent, r.Failed,
+		r.MaxQueueDepth, r.AvgQueueDepth)
+}
+
+// Run starts the processes with process.WithProcessFunc, writes unique keys with all of them
+// and waits until the entity has applied every write
+func Run(cfg Config) (Result, error) {
+	if cfg.Procs <= 0 || cfg.Writes <= 0 {
+		return Result{}, errors.New("procs and writes must be positive")
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = time.Minute
+	}
+
+	ent := entity.New(cfg.Procs, entity.WatchBuffer(cfg.Writes))
+	defer ent.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	events := ent.Watch(ctx, "")
+
+	var (
+		lk      sync.Mutex
+		addedAt = make(map[string]time.Time, cfg.Writes)
+		// closed when the processes may shut down
+		done  = make(chan struct{})
+		start = time.Now()
+	)
+	write := func(seed int64, n int) process.ProcessFunc {
+		return func(p process.Process) {
+			rnd := rand.New(rand.NewSource(seed))
+			for i := 0; i < n; i++ {
+				key := makeKey(rnd, fmt.Sprintf("%d/%d/", p.ID(), i), cfg.KeySize.sample(rnd))
+				value := makeValue(rnd, cfg.ValueSize.sample(rnd))
+				lk.Lock()
+				addedAt[key] = time.Now()
+				lk.Unlock()
+				p.Add(key, value)
+			}
+			<-done
+		}
+	}
+
+	procs := make([]process.Process, 0, cfg.Procs)
+	defer func() {
+		process.Shutdown(procs...)
+	}()
+	for i := 0; i < cfg.Procs; i++ {
+		n := cfg.Writes / cfg.Procs
+		if i < cfg.Writes%cfg.Procs {
+			n++
+		}
+		p, err := process.WithProcessFunc(i, write(cfg.Seed+int64(i), n), ent, cfg.Options...)
+		if err != nil {
+			close(done)
+			return Result{}, err
+		}
+		procs = append(procs, p)
+	}
+
+	res := Result{Writes: cfg.Writes}
+	latencies := make([]time.Duration, 0, cfg.Writes)
+	samples, depthSum := 0, 0
+	sample := time.NewTicker(sampleInterval)
+	defer sample.Stop()
+
+	var err error
+	for len(latencies) < cfg.Writes && err == nil {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				err = ErrTimeout
+				break
+			}
+			lk.Lock()
+			at, ok := addedAt[ev.Key]
+			delete(addedAt, ev.Key)
+			lk.Unlock()
+			if ok {
+				latencies = append(latencies, time.Since(at))
+			}
+
+		case <-sample.C:
+			depth := 0
+			for _, p := range procs {
+				s := p.Stats()
+				depth += s.Queued + s.Pending + s.InFlight
+			}
+			if depth > res.MaxQueueDepth {
+				res.MaxQueueDepth = depth
+			}
+			depthSum += depth
+			samples++
+		}
+	}
+	res.Elapsed = time.Since(start)
+	close(done)
+
+	for _, p := range procs {
+		s := p.Stats()
+		res.Sent += s.Sent
+		res.Resent += s.Resent
+		res.Failed += s.Failed
+	}
+	if samples > 0 {
+		res.AvgQueueDepth = float64(depthSum) / float64(samples)
+	}
+	res.Acked = len(latencies)
+	res.Throughput = float64(res.Acked) / res.Elapsed.Seconds()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	res.P50 = percentile(latencies, 50)
+	res.P99 = percentile(latencies, 99)
+	res.Max = percentile(latencies, 100)
+	return res, err
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return sorted[i]
+}
+
+const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// makeKey pads the unique prefix to size with random letters
+func makeKey(rnd *rand.Rand, prefix string, size int) string {
+	if size <= len(prefix) {
+		return prefix
+	}
+	return prefix + makeValue(rnd, size-len(prefix))
+}
+
+func makeValue(rnd *rand.Rand, size int) string {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = letters[rnd.Intn(len(letters))]
+	}
+	return string(b)
+}
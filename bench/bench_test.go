@@ -0,0 +1,76 @@
+package bench
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/qwertyqq2/entity/process"
+)
+
+func TestParseDist(t *testing.T) {
+	for s, want := range map[string]Dist{
+		"64":      {Min: 64, Max: 64},
+		"16-256":  {Min: 16, Max: 256},
+		"exp:128": {Mean: 128},
+	} {
+		d, err := ParseDist(s)
+		if err != nil {
+			t.Fatal(s, err)
+		}
+		if d != want || d.String() != s {
+			t.Fatal("wrong dist", s, d)
+		}
+	}
+	for _, s := range []string{"", "-1", "8-4", "exp:0", "big"} {
+		if _, err := ParseDist(s); err == nil {
+			t.Fatal("expected error", s)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	res, err := Run(Config{
+		Procs:     2,
+		Writes:    100,
+		KeySize:   Dist{Min: 8, Max: 32},
+		ValueSize: Dist{Mean: 64, Max: 1024},
+		Options:   options(1 << 20),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Acked != 100 || res.Sent < 100 || res.P50 > res.P99 || res.MaxQueueDepth == 0 {
+		t.Fatal("wrong result", res)
+	}
+}
+
+func options(maxMsgSize int) []process.Option {
+	return append(process.DefaultOpts(),
+		process.MaxMsgSize(maxMsgSize),
+		process.ResentInterval(100*time.Millisecond),
+	)
+}
+
+// BenchmarkProcesses writes b.N keys with 4 processes for every MaxMsgSize
+func BenchmarkProcesses(b *testing.B) {
+	for _, size := range []int{4 << 10, 64 << 10} {
+		b.Run(fmt.Sprintf("max-msg-size-%d", size), func(b *testing.B) {
+			res, err := Run(Config{
+				Procs:     4,
+				Writes:    b.N,
+				KeySize:   Dist{Min: 16, Max: 16},
+				ValueSize: Dist{Min: 64, Max: 64},
+				Options:   options(size),
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(res.Throughput, "writes/s")
+			b.ReportMetric(float64(res.P50.Microseconds()), "p50-µs")
+			b.ReportMetric(float64(res.P99.Microseconds()), "p99-µs")
+			b.ReportMetric(float64(res.Resent)/float64(b.N), "resent/op")
+			b.ReportMetric(float64(res.MaxQueueDepth), "max-depth")
+		})
+	}
+}
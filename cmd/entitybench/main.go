@@ -0,0 +1,76 @@
+// Command entitybench measures the throughput of processes writing to an in-memory entity.
+//
+//	entitybench [-procs N] [-writes N] [-key SIZE] [-value SIZE] [process options]
+//
+// A SIZE is "N", "MIN-MAX" or "exp:MEAN". The options of the processes are the
+// batching knobs, so runs with different values show how to size them
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	opts "github.com/qwertyqq2/entity"
+	"github.com/qwertyqq2/entity/bench"
+	"github.com/qwertyqq2/entity/process"
+)
+
+func main() {
+	var (
+		procs   = flag.Int("procs", 4, "number of processes")
+		writes  = flag.Int("writes", 10000, "writes of all processes")
+		key     = flag.String("key", "16", "key size")
+		value   = flag.String("value", "64", "value size")
+		timeout = flag.Duration("timeout", time.Minute, "how long to wait for the acks")
+		seed    = flag.Int64("seed", 1, "seed of the sizes and data")
+
+		maxMsgSize     = flag.Int("max-msg-size", opts.MaxMsgSize, "MaxMsgSize of the processes")
+		sendMsgCutoff  = flag.Int("send-msg-cutoff", opts.SendMsgCutoff, "SendMsgCutoff of the processes")
+		maxDelay       = flag.Duration("send-max-delay", opts.SendMessageMaxDelay, "SendMessageMaxDelay of the processes")
+		resentInterval = flag.Duration("resent-interval", opts.ResentInterval, "ResentInterval of the processes")
+		waitResp       = flag.Duration("wait-resp", opts.WaitSendInterval, "WaitRespInterval of the processes")
+		maxInFlight    = flag.Int("max-in-flight", opts.MaxInFlight, "MaxInFlight of the processes")
+	)
+	flag.Parse()
+
+	keySize, err := bench.ParseDist(*key)
+	if err != nil {
+		fail(err)
+	}
+	valueSize, err := bench.ParseDist(*value)
+	if err != nil {
+		fail(err)
+	}
+
+	cfg := bench.Config{
+		Procs:     *procs,
+		Writes:    *writes,
+		KeySize:   keySize,
+		ValueSize: valueSize,
+		Timeout:   *timeout,
+		Seed:      *seed,
+		Options: append(process.DefaultOpts(),
+			process.MaxMsgSize(*maxMsgSize),
+			process.SendMsgCutoff(*sendMsgCutoff),
+			process.SendMessageMaxDelay(*maxDelay),
+			process.ResentInterval(*resentInterval),
+			process.WaitRespInterval(*waitResp),
+			process.MaxInFlight(*maxInFlight),
+		),
+	}
+	fmt.Printf("procs %d, key %v, value %v, max msg size %d, send msg cutoff %d, send max delay %v, max in flight %d\n",
+		cfg.Procs, keySize, valueSize, *maxMsgSize, *sendMsgCutoff, *maxDelay, *maxInFlight)
+
+	res, err := bench.Run(cfg)
+	fmt.Println(res)
+	if err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "entitybench:", err)
+	os.Exit(1)
+}
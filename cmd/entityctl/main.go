@@ -0,0 +1,401 @@
+// Command entityctl inspects and drives an entity.
+//
+//	entityctl [-dir DIR | -addr HOST:PORT] [-id N] COMMAND [ARGS]
+//
+// With -dir the entity is opened in the process from its data dir,
+// with -addr it is reached over TCP, without both an empty in-memory entity is used.
+//
+//	put [-ttl D] KEY DATA   writes the key
+//	del KEY                 deletes the key
+//	get KEY                 prints the value as a JSON line
+//	dump                    prints all values as JSON lines, needs -dir
+//	stats                   prints the number of keys, needs -dir
+//	bench [-n N] [-procs P] [-size S] [-msg-size M]
+//	                        writes N keys with P processes and one more that checks them,
+//	                        prints the throughput, refuses -dir not to leave its keys in the data
+//	load FILE               writes the JSON lines of FILE, "-" is stdin, dump output can be loaded
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	opts "github.com/qwertyqq2/entity"
+	"github.com/qwertyqq2/entity/entity"
+	"github.com/qwertyqq2/entity/process"
+)
+
+const (
+	procLimit = 64
+	// writes of load in one txn
+	loadBatch = 100
+)
+
+var (
+	errUsage    = errors.New("usage: entityctl [-dir DIR | -addr HOST:PORT] [-id N] put|del|get|dump|stats|bench|load")
+	errEmbedded = errors.New("command needs an embedded entity, use -dir")
+	errBenchDir = errors.New("bench would leave its keys in the data dir, run it without -dir")
+)
+
+// Value is a line of get, dump and load
+type Value struct {
+	// only in load, "put" by default
+	Op        string     `json:"op,omitempty"`
+	Key       string     `json:"key"`
+	Data      string     `json:"data"`
+	Version   uint64     `json:"version,omitempty"`
+	TTL       string     `json:"ttl,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type ctl struct {
+	// nil over the network
+	ent entity.Entity
+	tr  process.Transport
+	id  int
+	out io.Writer
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "entityctl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("entityctl", flag.ContinueOnError)
+	dir := fs.String("dir", "", "data dir of an embedded entity")
+	addr := fs.String("addr", "", "address of an entity server")
+	id := fs.Int("id", 1, "id of the first process")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 || (*dir != "" && *addr != "") {
+		return errUsage
+	}
+
+	c := &ctl{id: *id, out: out}
+	switch {
+	case *dir != "":
+		ent, err := entity.Open(*dir, procLimit)
+		if err != nil {
+			return err
+		}
+		defer ent.Shutdown()
+		c.ent, c.tr = ent, ent
+	case *addr != "":
+		c.tr = process.DialTCP(*addr)
+	default:
+		ent := entity.New(procLimit)
+		defer ent.Shutdown()
+		c.ent, c.tr = ent, ent
+	}
+
+	cmd, args := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "put":
+		return c.put(args)
+	case "del":
+		return c.del(args)
+	case "get":
+		return c.get(args)
+	case "dump":
+		return c.dump()
+	case "stats":
+		return c.stats()
+	case "bench":
+		if *dir != "" {
+			return errBenchDir
+		}
+		return c.bench(args)
+	case "load":
+		return c.load(args)
+	default:
+		return errUsage
+	}
+}
+
+func (c *ctl) process(id int, o ...process.Option) (process.Process, error) {
+	return process.WithEntity(id, c.tr, append(process.DefaultOpts(), o...)...)
+}
+
+// txn applies fn with the first process, the writes are acked when it returns
+func (c *ctl) txn(fn func(tx process.Tx)) error {
+	p, err := c.process(c.id)
+	if err != nil {
+		return err
+	}
+	defer p.Shutdown()
+	return p.Txn(fn)
+}
+
+func (c *ctl) put(args []string) error {
+	fs := flag.NewFlagSet("put", flag.ContinueOnError)
+	ttl := fs.Duration("ttl", 0, "drop the key after ttl")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("usage: put [-ttl D] KEY DATA")
+	}
+	key, data := fs.Arg(0), fs.Arg(1)
+	return c.txn(func(tx process.Tx) {
+		if *ttl > 0 {
+			tx.AddWithTTL(key, data, *ttl)
+			return
+		}
+		tx.Add(key, data)
+	})
+}
+
+func (c *ctl) del(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: del KEY")
+	}
+	return c.txn(func(tx process.Tx) {
+		tx.Delete(args[0])
+	})
+}
+
+func (c *ctl) get(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: get KEY")
+	}
+	p, err := c.process(c.id)
+	if err != nil {
+		return err
+	}
+	defer p.Shutdown()
+
+	in, err := p.Get(args[0])
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(c.out).Encode(newValue(in))
+}
+
+func newValue(in entity.Inside) Value {
+	v := Value{Key: in.Key, Data: in.Data, Version: in.Version}
+	if !in.ExpiresAt.IsZero() {
+		v.ExpiresAt = &in.ExpiresAt
+	}
+	return v
+}
+
+func (c *ctl) dump() error {
+	if c.ent == nil {
+		return errEmbedded
+	}
+	var buf bytes.Buffer
+	if err := c.ent.Snapshot(&buf); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(c.out)
+	return entity.ReadSnapshot(&buf, func(in entity.Inside) error {
+		return enc.Encode(newValue(in))
+	})
+}
+
+func (c *ctl) stats() error {
+	if c.ent == nil {
+		return errEmbedded
+	}
+	return json.NewEncoder(c.out).Encode(map[string]int{"keys": c.ent.Len()})
+}
+
+func (c *ctl) load(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: load FILE")
+	}
+	r := io.Reader(os.Stdin)
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	p, err := c.process(c.id)
+	if err != nil {
+		return err
+	}
+	defer p.Shutdown()
+
+	var (
+		batch = make([]Value, 0, loadBatch)
+		n     = 0
+		line  = 0
+	)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := p.Txn(func(tx process.Tx) {
+			for _, v := range batch {
+				apply(tx, v)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		n += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 64<<20)
+	for sc.Scan() {
+		line++
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		var v Value
+		if err := json.Unmarshal(sc.Bytes(), &v); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		ok, err := v.resolve(time.Now())
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if !ok {
+			continue
+		}
+		batch = append(batch, v)
+		if len(batch) == loadBatch {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out, "loaded", n)
+	return nil
+}
+
+// resolve checks the line and turns expires_at into ttl.
+// A value that has already expired is skipped
+func (v *Value) resolve(now time.Time) (bool, error) {
+	if v.Key == "" {
+		return false, errors.New("empty key")
+	}
+	if v.Op == "" {
+		v.Op = "put"
+	}
+	switch v.Op {
+	case "put":
+	case "delete":
+		return true, nil
+	default:
+		return false, errors.New("unknown op " + v.Op)
+	}
+
+	if v.TTL != "" {
+		if _, err := time.ParseDuration(v.TTL); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if v.ExpiresAt != nil {
+		ttl := v.ExpiresAt.Sub(now)
+		if ttl <= 0 {
+			return false, nil
+		}
+		v.TTL = ttl.String()
+	}
+	return true, nil
+}
+
+func apply(tx process.Tx, v Value) {
+	if v.Op == "delete" {
+		tx.Delete(v.Key)
+		return
+	}
+	if ttl, _ := time.ParseDuration(v.TTL); ttl > 0 {
+		tx.AddWithTTL(v.Key, v.Data, ttl)
+		return
+	}
+	tx.Add(v.Key, v.Data)
+}
+
+func (c *ctl) bench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	n := fs.Int("n", 10000, "number of writes")
+	procs := fs.Int("procs", 4, "number of processes")
+	size := fs.Int("size", 64, "size of the data")
+	msgSize := fs.Int("msg-size", opts.MaxMsgSize, "MaxMsgSize of the processes")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *n <= 0 || *procs <= 0 || *size < 0 {
+		return errors.New("usage: bench [-n N] [-procs P] [-size S] [-msg-size M]")
+	}
+
+	data := make([]byte, *size)
+	rand.Read(data)
+	value := fmt.Sprintf("%x", data)[:*size]
+
+	// the last process only checks the keys, its requests do not go in between the writes of a writer
+	ps := make([]process.Process, 0, *procs+1)
+	defer func() {
+		process.Shutdown(ps...)
+	}()
+	for i := 0; i <= *procs; i++ {
+		p, err := c.process(c.id+i, process.MaxMsgSize(*msgSize))
+		if err != nil {
+			return err
+		}
+		ps = append(ps, p)
+	}
+	writers, checker := ps[:*procs], ps[*procs]
+
+	start := time.Now()
+	keys := make([]string, 0, *n)
+	for i := 0; i < *n; i++ {
+		p := writers[i%*procs]
+		key := fmt.Sprintf("bench/%d/%d", p.ID(), i)
+		p.Add(key, value)
+		keys = append(keys, key)
+	}
+	// the writes are applied once all keys are seen
+	for _, key := range keys {
+		if err := waitKey(checker, key); err != nil {
+			return err
+		}
+	}
+	elapsed := time.Since(start)
+
+	fmt.Fprintf(c.out, "writes %d, processes %d, size %d, elapsed %v, %.0f writes/s\n",
+		*n, *procs, *size, elapsed.Round(time.Millisecond), float64(*n)/elapsed.Seconds())
+	return nil
+}
+
+func waitKey(p process.Process, key string) error {
+	for {
+		ok, err := p.Has(key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
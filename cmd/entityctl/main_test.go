@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/qwertyqq2/entity/entity"
+	"github.com/qwertyqq2/entity/entity/server"
+)
+
+func runCtl(t *testing.T, args ...string) string {
+	var out bytes.Buffer
+	if err := run(args, &out); err != nil {
+		t.Fatal(args, err)
+	}
+	return out.String()
+}
+
+func TestPutGetDel(t *testing.T) {
+	dir := t.TempDir()
+
+	runCtl(t, "-dir", dir, "put", "k1", "is k1")
+	runCtl(t, "-dir", dir, "put", "-ttl", "1h", "k2", "is k2")
+
+	var v Value
+	if err := json.Unmarshal([]byte(runCtl(t, "-dir", dir, "get", "k1")), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Key != "k1" || v.Data != "is k1" || v.Version != 1 {
+		t.Fatal("wrong value", v)
+	}
+
+	runCtl(t, "-dir", dir, "del", "k1")
+	if err := run([]string{"-dir", dir, "get", "k1"}, &bytes.Buffer{}); err == nil {
+		t.Fatal("k1 must be deleted")
+	}
+	if out := runCtl(t, "-dir", dir, "stats"); out != "{\"keys\":1}\n" {
+		t.Fatal("wrong stats", out)
+	}
+
+	// bench does not write into the data
+	if err := run([]string{"-dir", dir, "bench", "-n", "10"}, &bytes.Buffer{}); err != errBenchDir {
+		t.Fatal("expected bench dir error", err)
+	}
+	if out := runCtl(t, "-dir", dir, "stats"); out != "{\"keys\":1}\n" {
+		t.Fatal("wrong stats after bench", out)
+	}
+}
+
+func TestDumpLoad(t *testing.T) {
+	dir := t.TempDir()
+	runCtl(t, "-dir", dir, "put", "k1", "is k1")
+	runCtl(t, "-dir", dir, "put", "-ttl", "1h", "k2", "is\tk2\n")
+
+	dump := runCtl(t, "-dir", dir, "dump")
+	if strings.Count(dump, "\n") != 2 {
+		t.Fatal("wrong dump", dump)
+	}
+	file := filepath.Join(t.TempDir(), "dump")
+	if err := os.WriteFile(file, []byte(dump+`{"op":"delete","key":"k3"}`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	other := t.TempDir()
+	runCtl(t, "-dir", other, "put", "k3", "is k3")
+	if out := runCtl(t, "-dir", other, "load", file); out != "loaded 3\n" {
+		t.Fatal("wrong load", out)
+	}
+
+	var v Value
+	if err := json.Unmarshal([]byte(runCtl(t, "-dir", other, "get", "k2")), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Data != "is\tk2\n" || v.ExpiresAt == nil {
+		t.Fatal("wrong value", v)
+	}
+	if out := runCtl(t, "-dir", other, "stats"); out != "{\"keys\":2}\n" {
+		t.Fatal("wrong stats", out)
+	}
+}
+
+func TestRemote(t *testing.T) {
+	ent := entity.New(procLimit)
+	defer ent.Shutdown()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := server.New(ent)
+	go srv.Serve(l)
+	defer srv.Close()
+	addr := l.Addr().String()
+
+	runCtl(t, "-addr", addr, "put", "k1", "is k1")
+	if ent.Len() != 1 {
+		t.Fatal("wrong len", ent.Len())
+	}
+	if out := runCtl(t, "-addr", addr, "bench", "-n", "100", "-procs", "2", "-msg-size", "100000"); !strings.HasPrefix(out, "writes 100") {
+		t.Fatal("wrong bench", out)
+	}
+	if ent.Len() != 101 {
+		t.Fatal("wrong len", ent.Len())
+	}
+	if err := run([]string{"-addr", addr, "dump"}, &bytes.Buffer{}); err != errEmbedded {
+		t.Fatal("expected embedded error", err)
+	}
+}
@@ -0,0 +1,45 @@
+package entity
+
+import (
+	mes "github.com/qwertyqq2/entity/message"
+)
+
+func (e *entity) handleBatch(id int, m Message) Message {
+	resp := mes.SuccessMessage()
+	resp.Ops = e.batch(id, m.Ops)
+	return resp
+}
+
+// batch applies every Add and Delete of the process proc on its own under one lock acquisition,
+// unlike a txn a failed op does not stop the others. The result of every op is returned
+func (e *entity) batch(proc int, ops []Message) []Message {
+	e.qlk.Lock()
+	defer e.qlk.Unlock()
+	e.lk.Lock()
+	defer e.lk.Unlock()
+
+	results := make([]Message, 0, len(ops))
+	for _, m := range ops {
+		if e.seqs.applied(proc, m) {
+			results = append(results, mes.SuccessMessage())
+			continue
+		}
+
+		var err error
+		switch m.Op {
+		case mes.Add:
+			_, err = e.put(proc, m.Seq, mes.Add, e.toStore(m))
+		case mes.Delete:
+			err = e.remove(proc, m.Seq, m.Inside.Key)
+		default:
+			err = ErrBatchOp
+		}
+		if err != nil {
+			results = append(results, mes.FailMessage(err))
+			continue
+		}
+		e.seqs.mark(proc, m, e.clock.Now())
+		results = append(results, mes.SuccessMessage())
+	}
+	return results
+}
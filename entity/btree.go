@@ -0,0 +1,297 @@
+package entity
+
+import "sort"
+
+const defaultBTreeDegree = 32
+
+// In-memory store that keeps keys ordered, Iterate goes in ascending key order
+type BTreeStore struct {
+	root   *btreeNode
+	degree int
+	length int
+}
+
+// A node holds from degree-1 to 2*degree-1 items, the root may hold less
+type btreeNode struct {
+	items    []Inside
+	children []*btreeNode
+}
+
+// NewBTreeStore with the minimum degree of the tree, the default is used if degree < 2
+func NewBTreeStore(degree int) *BTreeStore {
+	if degree < 2 {
+		degree = defaultBTreeDegree
+	}
+	return &BTreeStore{
+		degree: degree,
+	}
+}
+
+func (t *BTreeStore) Get(key string) (Inside, error) {
+	n := t.root
+	for n != nil {
+		i, found := n.find(key)
+		if found {
+			return n.items[i], nil
+		}
+		if n.leaf() {
+			break
+		}
+		n = n.children[i]
+	}
+	return Inside{}, ErrNotFound
+}
+
+func (t *BTreeStore) Put(in Inside) error {
+	if t.root == nil {
+		t.root = &btreeNode{items: []Inside{in}}
+		t.length++
+		return nil
+	}
+	if len(t.root.items) == t.maxItems() {
+		root := &btreeNode{children: []*btreeNode{t.root}}
+		root.split(0, t.degree)
+		t.root = root
+	}
+	if t.root.insert(in, t.degree) {
+		t.length++
+	}
+	return nil
+}
+
+func (t *BTreeStore) Delete(key string) error {
+	if t.root == nil {
+		return nil
+	}
+	if t.root.remove(key, t.degree) {
+		t.length--
+	}
+	if len(t.root.items) == 0 {
+		if t.root.leaf() {
+			t.root = nil
+		} else {
+			t.root = t.root.children[0]
+		}
+	}
+	return nil
+}
+
+func (t *BTreeStore) Iterate(fn func(in Inside) bool) error {
+	if t.root != nil {
+		t.root.ascend(fn)
+	}
+	return nil
+}
+
+func (t *BTreeStore) Len() int {
+	return t.length
+}
+
+func (t *BTreeStore) maxItems() int {
+	return 2*t.degree - 1
+}
+
+func (n *btreeNode) leaf() bool {
+	return len(n.children) == 0
+}
+
+// find returns the index of the first item not less than key
+func (n *btreeNode) find(key string) (int, bool) {
+	i := sort.Search(len(n.items), func(i int) bool {
+		return n.items[i].Key >= key
+	})
+	return i, i < len(n.items) && n.items[i].Key == key
+}
+
+// split the full child i into two nodes around its middle item
+func (n *btreeNode) split(i, degree int) {
+	child := n.children[i]
+	mid := child.items[degree-1]
+
+	right := &btreeNode{
+		items: append([]Inside(nil), child.items[degree:]...),
+	}
+	if !child.leaf() {
+		right.children = append([]*btreeNode(nil), child.children[degree:]...)
+		child.children = child.children[:degree]
+	}
+	child.items = child.items[:degree-1]
+
+	n.items = insertItem(n.items, i, mid)
+	n.children = insertChild(n.children, i+1, right)
+}
+
+// insert into a node that is not full, returns false if the key was replaced
+func (n *btreeNode) insert(in Inside, degree int) bool {
+	i, found := n.find(in.Key)
+	if found {
+		n.items[i] = in
+		return false
+	}
+	if n.leaf() {
+		n.items = insertItem(n.items, i, in)
+		return true
+	}
+	if len(n.children[i].items) == 2*degree-1 {
+		n.split(i, degree)
+		switch {
+		case in.Key == n.items[i].Key:
+			n.items[i] = in
+			return false
+		case in.Key > n.items[i].Key:
+			i++
+		}
+	}
+	return n.children[i].insert(in, degree)
+}
+
+// remove the key from the subtree, every visited child is refilled up to degree items first
+func (n *btreeNode) remove(key string, degree int) bool {
+	i, found := n.find(key)
+	if n.leaf() {
+		if !found {
+			return false
+		}
+		n.items = removeItem(n.items, i)
+		return true
+	}
+
+	if found {
+		switch {
+		case len(n.children[i].items) >= degree:
+			pred := n.children[i].max()
+			n.items[i] = pred
+			return n.children[i].remove(pred.Key, degree)
+
+		case len(n.children[i+1].items) >= degree:
+			succ := n.children[i+1].min()
+			n.items[i] = succ
+			return n.children[i+1].remove(succ.Key, degree)
+
+		default:
+			n.merge(i)
+			return n.children[i].remove(key, degree)
+		}
+	}
+
+	if len(n.children[i].items) < degree {
+		i = n.fill(i, degree)
+	}
+	return n.children[i].remove(key, degree)
+}
+
+// fill the child i from a sibling, returns the index of the child that now covers its keys
+func (n *btreeNode) fill(i, degree int) int {
+	switch {
+	case i > 0 && len(n.children[i-1].items) >= degree:
+		n.borrowFromPrev(i)
+		return i
+
+	case i < len(n.children)-1 && len(n.children[i+1].items) >= degree:
+		n.borrowFromNext(i)
+		return i
+
+	case i < len(n.children)-1:
+		n.merge(i)
+		return i
+
+	default:
+		n.merge(i - 1)
+		return i - 1
+	}
+}
+
+func (n *btreeNode) borrowFromPrev(i int) {
+	child, sib := n.children[i], n.children[i-1]
+
+	child.items = insertItem(child.items, 0, n.items[i-1])
+	last := len(sib.items) - 1
+	n.items[i-1] = sib.items[last]
+	sib.items = sib.items[:last]
+
+	if !sib.leaf() {
+		last := len(sib.children) - 1
+		child.children = insertChild(child.children, 0, sib.children[last])
+		sib.children = sib.children[:last]
+	}
+}
+
+func (n *btreeNode) borrowFromNext(i int) {
+	child, sib := n.children[i], n.children[i+1]
+
+	child.items = append(child.items, n.items[i])
+	n.items[i] = sib.items[0]
+	sib.items = removeItem(sib.items, 0)
+
+	if !sib.leaf() {
+		child.children = append(child.children, sib.children[0])
+		sib.children = removeChild(sib.children, 0)
+	}
+}
+
+// merge the child i+1 and the separating item into the child i
+func (n *btreeNode) merge(i int) {
+	child, sib := n.children[i], n.children[i+1]
+
+	child.items = append(child.items, n.items[i])
+	child.items = append(child.items, sib.items...)
+	child.children = append(child.children, sib.children...)
+
+	n.items = removeItem(n.items, i)
+	n.children = removeChild(n.children, i+1)
+}
+
+func (n *btreeNode) min() Inside {
+	for !n.leaf() {
+		n = n.children[0]
+	}
+	return n.items[0]
+}
+
+func (n *btreeNode) max() Inside {
+	for !n.leaf() {
+		n = n.children[len(n.children)-1]
+	}
+	return n.items[len(n.items)-1]
+}
+
+func (n *btreeNode) ascend(fn func(in Inside) bool) bool {
+	for i, in := range n.items {
+		if !n.leaf() && !n.children[i].ascend(fn) {
+			return false
+		}
+		if !fn(in) {
+			return false
+		}
+	}
+	if !n.leaf() {
+		return n.children[len(n.items)].ascend(fn)
+	}
+	return true
+}
+
+func insertItem(items []Inside, i int, in Inside) []Inside {
+	items = append(items, Inside{})
+	copy(items[i+1:], items[i:])
+	items[i] = in
+	return items
+}
+
+func removeItem(items []Inside, i int) []Inside {
+	copy(items[i:], items[i+1:])
+	items[len(items)-1] = Inside{}
+	return items[:len(items)-1]
+}
+
+func insertChild(children []*btreeNode, i int, c *btreeNode) []*btreeNode {
+	children = append(children, nil)
+	copy(children[i+1:], children[i:])
+	children[i] = c
+	return children
+}
+
+func removeChild(children []*btreeNode, i int) []*btreeNode {
+	copy(children[i:], children[i+1:])
+	children[len(children)-1] = nil
+	return children[:len(children)-1]
+}
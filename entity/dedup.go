@@ -0,0 +1,113 @@
+package entity
+
+import (
+	"time"
+
+	mes "github.com/qwertyqq2/entity/message"
+)
+
+const defaultDedupWindow = 10 * time.Minute
+
+// Sequences of the writes applied for every process.
+// The process sends the writes of different keys in any order and resends them after a timeout,
+// so the last sequence is kept for every key: a write with a sequence that is not above it
+// is a duplicate or older than the write already applied, it is dropped and answered with Success.
+// A sequence is kept for the dedup window after its write, also once the key is removed
+// or the process is gone, a late resend is not applied again within it.
+// The sequences are logged with their writes and saved in the snapshot,
+// after a restart the loaded ones get a whole window again
+type seqs struct {
+	last map[int]map[string]uint64
+	// marks in the order they are made, the oldest first
+	order  []seqMark
+	window time.Duration
+}
+
+type seqMark struct {
+	proc int
+	key  string
+	seq  uint64
+	at   time.Time
+}
+
+func newSeqs() *seqs {
+	return &seqs{
+		last:   make(map[int]map[string]uint64),
+		window: defaultDedupWindow,
+	}
+}
+
+// applied reports whether a write with m.Seq or a newer one was applied for the key
+func (s *seqs) applied(proc int, m Message) bool {
+	if m.Seq == 0 {
+		return false
+	}
+	return m.Seq <= s.last[proc][m.Inside.Key]
+}
+
+// mark remembers that m is applied at now
+func (s *seqs) mark(proc int, m Message, now time.Time) {
+	s.set(seqMark{proc: proc, key: m.Inside.Key, seq: m.Seq, at: now})
+}
+
+func (s *seqs) set(sm seqMark) {
+	if sm.seq == 0 {
+		return
+	}
+	keys, ok := s.last[sm.proc]
+	if !ok {
+		keys = make(map[string]uint64)
+		s.last[sm.proc] = keys
+	}
+	if sm.seq > keys[sm.key] {
+		keys[sm.key] = sm.seq
+		s.order = append(s.order, sm)
+	}
+}
+
+// prune forgets the sequences marked a window before now, a zero window keeps them all
+func (s *seqs) prune(now time.Time) {
+	if s.window <= 0 {
+		return
+	}
+	n := 0
+	for ; n < len(s.order) && now.Sub(s.order[n].at) >= s.window; n++ {
+		sm := s.order[n]
+		// a newer mark of the key is further in the order
+		if keys := s.last[sm.proc]; keys[sm.key] == sm.seq {
+			delete(keys, sm.key)
+			if len(keys) == 0 {
+				delete(s.last, sm.proc)
+			}
+		}
+	}
+	if n > 0 {
+		s.order = append(s.order[:0], s.order[n:]...)
+	}
+}
+
+// marks returns the kept sequences, the oldest first
+func (s *seqs) marks() []seqMark {
+	marks := make([]seqMark, 0, len(s.order))
+	for _, sm := range s.order {
+		if s.last[sm.proc][sm.key] == sm.seq {
+			marks = append(marks, sm)
+		}
+	}
+	return marks
+}
+
+// handleWrite applies the Add or Delete m once for its sequence
+func (e *entity) handleWrite(id int, m Message, apply func(id int, m Message) error) Message {
+	e.qlk.Lock()
+	defer e.qlk.Unlock()
+
+	if e.seqs.applied(id, m) {
+		return mes.SuccessMessage()
+	}
+	if err := apply(id, m); err != nil {
+		return mes.FailMessage(err)
+	}
+	e.seqs.mark(id, m, e.clock.Now())
+	return mes.SuccessMessage()
+}
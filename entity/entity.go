@@ -4,8 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/benbjohnson/clock"
@@ -13,13 +15,23 @@ import (
 )
 
 const (
-	delayDisconnect = 10 * time.Second
-	delayResponse   = 5 * time.Second
+	delayDisconnect      = 10 * time.Second
+	delayResponse        = 5 * time.Second
+	defaultSessionBuffer = 100
 )
 
 type Message = mes.Message
 type Inside = mes.Inside
 
+var (
+	ErrNotFound        = mes.ErrNotFound
+	ErrVersionMismatch = mes.ErrVersionMismatch
+	ErrTxnOp           = mes.ErrTxnOp
+	ErrBatchOp         = mes.ErrBatchOp
+
+	ErrProcLimit = errors.New("limit processes")
+)
+
 // Key-value store
 type Entity interface {
 	//Closeing entity
@@ -31,85 +43,372 @@ type Entity interface {
 	//Disconnect a process from an entity
 	Disconnect(id int) error
 
-	//Getting response on request asynchronously
+	//Getting response on request asynchronously.
+	//The response has the request id of the message
 	Resp(id int) Message
 
+	// Resp that returns a nil message as soon as ctx is done
+	RespContext(ctx context.Context, id int) Message
+
+	// Closed when the session of the process ends by Disconnect, the idle timeout or an error.
+	// Already closed if the process is not connected
+	Done(id int) <-chan struct{}
+
 	//Display data in entities
 	String() string
 
 	// Len of entity
 	Len() int
+
+	// Writes all data to w in the snapshot format, see Restore
+	Snapshot(w io.Writer) error
+
+	// Saves a snapshot and truncates the log of a persistent entity.
+	// Does nothing for an in-memory entity
+	Compact() error
+
+	// Changes of the keys with the prefix until ctx is done.
+	// A watcher that falls behind by more than the buffer is dropped and its channel closed
+	Watch(ctx context.Context, prefix string) <-chan Event
 }
 
 type entity struct {
 	ctx      context.Context
 	shutdown func()
 
-	vals map[string]Inside
-	lk   sync.RWMutex
+	store  Store
+	expiry *wheel
+	wal    *wal
+	dir    string
+	lk     sync.RWMutex
 
-	sessions  map[int]struct{}
-	inside    map[int]chan Message
-	proc      int
-	procLimit int
-	slk       sync.RWMutex
+	clock  clock.Clock
+	logger *slog.Logger
+
+	watchers    map[*watcher]struct{}
+	watchBuffer int
+	wlk         sync.Mutex
+
+	syncWrites       bool
+	snapshotInterval time.Duration
+
+	sessions    map[int]*session
+	proc        int
+	procLimit   int
+	limitPolicy LimitPolicy
+	slk         sync.RWMutex
+
+	idleTimeout   time.Duration
+	respTimeout   time.Duration
+	sessionBuffer int
+
+	seqs *seqs
+	qlk  sync.Mutex
+
+	// highest version of a removed or expired key, a key written again goes on above it.
+	// Under lk
+	floor uint64
 }
 
-func New(procLimit int) Entity {
+func New(procLimit int, opts ...Option) Entity {
+	return newEntity(procLimit, opts...)
+}
+
+// Open an entity that keeps its data in dir.
+// Every Add and Delete is written to the log before the process gets Success,
+// on open the last snapshot is loaded and the log is replayed over it.
+// A DurableStore keeps the values itself, it only gets the log records it misses
+func Open(dir string, procLimit int, opts ...Option) (Entity, error) {
+	e := newEntity(procLimit, opts...)
+
+	wal, err := openWal(dir, e.syncWrites)
+	if err != nil {
+		e.shutdown()
+		return nil, err
+	}
+	// the loaded sequences get a whole dedup window from now
+	now := e.clock.Now()
+	mark := func(sm seqMark) {
+		sm.at = now
+		e.seqs.set(sm)
+	}
+	put := e.store.Put
+	if isDurable(e.store) {
+		put = func(Inside) error { return nil }
+	}
+	if e.floor, err = loadSnapshot(dir, put, mark); err != nil {
+		wal.close()
+		e.close()
+		return nil, err
+	}
+	// only the last record of a key is applied, once the whole log is read
+	last := make(map[string]walOp)
+	err = wal.replay(func(o walOp) error {
+		mark(seqMark{proc: o.proc, key: o.in.Key, seq: o.seq})
+		switch o.op {
+		case mes.Add:
+			last[o.in.Key] = o
+		case mes.Delete:
+			e.retire(o.in)
+			last[o.in.Key] = o
+		}
+		return nil
+	})
+	if err == nil {
+		for _, o := range last {
+			if err = e.restoreOp(o); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		wal.close()
+		e.close()
+		return nil, err
+	}
+	e.wal = wal
+	e.dir = dir
+
+	if err := e.scheduleExpiry(); err != nil {
+		e.close()
+		return nil, err
+	}
+	if e.snapshotInterval > 0 {
+		go e.compactLoop()
+	}
+	return e, nil
+}
+
+// restoreOp writes the last logged op of a key unless the store has it already
+func (e *entity) restoreOp(o walOp) error {
+	in, err := e.store.Get(o.in.Key)
+	switch {
+	case err == ErrNotFound:
+		if o.op == mes.Delete {
+			return nil
+		}
+	case err != nil:
+		return err
+	case o.op == mes.Delete:
+		return e.store.Delete(o.in.Key)
+	case in.Data == o.in.Data && in.Version == o.in.Version && in.ExpiresAt.Equal(o.in.ExpiresAt):
+		return nil
+	}
+	return e.store.Put(o.in)
+}
+
+// Restore an in-memory entity from a snapshot written by Entity.Snapshot
+func Restore(r io.Reader, procLimit int, opts ...Option) (Entity, error) {
+	e := newEntity(procLimit, opts...)
+	now := e.clock.Now()
+	floor, err := readSnapshot(r, e.store.Put, func(sm seqMark) {
+		sm.at = now
+		e.seqs.set(sm)
+	})
+	e.floor = floor
+	if err != nil {
+		e.close()
+		return nil, err
+	}
+	if err := e.scheduleExpiry(); err != nil {
+		e.close()
+		return nil, err
+	}
+	return e, nil
+}
+
+func newEntity(procLimit int, opts ...Option) *entity {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &entity{
-		ctx:       ctx,
-		shutdown:  cancel,
-		vals:      make(map[string]Inside),
-		sessions:  make(map[int]struct{}),
-		inside:    make(map[int]chan Message),
-		proc:      0,
-		procLimit: procLimit,
+	e := &entity{
+		ctx:         ctx,
+		shutdown:    cancel,
+		store:       NewMapStore(),
+		clock:       clock.New(),
+		logger:      discardLogger(),
+		watchers:    make(map[*watcher]struct{}),
+		watchBuffer: defaultWatchBuffer,
+		syncWrites:  true,
+		sessions:    make(map[int]*session),
+		proc:        0,
+		procLimit:   procLimit,
+		seqs:        newSeqs(),
+
+		idleTimeout:   delayDisconnect,
+		respTimeout:   delayResponse,
+		sessionBuffer: defaultSessionBuffer,
 	}
+	for _, o := range opts {
+		o(e)
+	}
+	e.expiry = newWheel(expiryTick, expirySlots, e.clock.Now())
+
+	go e.expireLoop()
+	return e
 }
 
 func (e *entity) Shutdown() {
+	e.close()
+}
+
+// close the log and the store if it holds any resources
+func (e *entity) close() {
 	e.shutdown()
+
+	e.lk.Lock()
+	defer e.lk.Unlock()
+	if e.wal != nil {
+		if err := e.wal.close(); err != nil {
+			e.logger.Error("close log", "err", err)
+		}
+	}
+	if c, ok := e.store.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			e.logger.Error("close store", "err", err)
+		}
+	}
+}
+
+func (e *entity) Snapshot(w io.Writer) error {
+	e.qlk.Lock()
+	defer e.qlk.Unlock()
+	e.lk.Lock()
+	defer e.lk.Unlock()
+
+	e.expire()
+	return writeSnapshot(w, e.store, e.floor, e.seqs.marks())
+}
+
+func (e *entity) Compact() error {
+	e.qlk.Lock()
+	defer e.qlk.Unlock()
+	e.lk.Lock()
+	defer e.lk.Unlock()
+
+	if e.wal == nil {
+		return nil
+	}
+	if e.wal.f == nil {
+		return ErrClosed
+	}
+	e.expire()
+	if err := saveSnapshot(e.dir, e.store, e.floor, e.seqs.marks()); err != nil {
+		return err
+	}
+	// the log is dropped only once the snapshot is on disk
+	return e.wal.reset()
+}
+
+func (e *entity) compactLoop() {
+	ticker := e.clock.Ticker(e.snapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := e.Compact(); err != nil {
+				e.logger.Error("compact", "err", err)
+			}
+
+		case <-e.ctx.Done():
+			return
+		}
+	}
 }
 
+// Session of a connected process
+type session struct {
+	// messages of the process
+	out chan Message
+	// responses to the process
+	in chan Message
+	// closed by Disconnect
+	stop chan struct{}
+	// closed once the session reads out
+	ready chan struct{}
+	// closed once the session no longer reads
+	done chan struct{}
+	// unix nano of the last message, the session idle the longest is evicted first
+	active atomic.Int64
+}
+
+func (e *entity) newSession() *session {
+	s := &session{
+		out:   make(chan Message, e.sessionBuffer),
+		in:    make(chan Message, e.sessionBuffer),
+		stop:  make(chan struct{}),
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	s.active.Store(e.clock.Now().UnixNano())
+	return s
+}
+
+// Connect returns once the session of the process is ready to read its messages
 func (e *entity) Connect(id int) (chan<- Message, error) {
 	e.slk.Lock()
-	_, ok := e.sessions[id]
-	if !ok && e.proc < e.procLimit {
-		e.sessions[id] = struct{}{}
-		e.proc++
+	if _, ok := e.sessions[id]; ok {
 		e.slk.Unlock()
-		in := e.startSession(id)
-		time.Sleep(100 * time.Millisecond)
-		return in, nil
-	}
-	e.slk.Unlock()
-	if ok {
 		return nil, fmt.Errorf("conn already exist")
 	}
 	if e.proc >= e.procLimit {
-		return nil, fmt.Errorf("limit processes")
+		if e.limitPolicy != EvictIdle || !e.evictIdle() {
+			e.slk.Unlock()
+			e.logger.Warn("connect over the limit", "proc", id, "limit", e.procLimit)
+			return nil, ErrProcLimit
+		}
 	}
-	return nil, nil
+	s := e.newSession()
+	e.sessions[id] = s
+	e.proc++
+	e.slk.Unlock()
+	e.logger.Info("connect", "proc", id)
+
+	e.startSession(id, s)
+	<-s.ready
+	return s.out, nil
 }
 
 func (e *entity) Disconnect(id int) error {
 	e.slk.Lock()
 	defer e.slk.Unlock()
 
-	if _, ok := e.sessions[id]; ok {
-		delete(e.sessions, id)
-		delete(e.inside, id)
-		e.proc--
+	if s, ok := e.sessions[id]; ok {
+		close(s.stop)
+		e.drop(id)
+		e.logger.Info("disconnect", "proc", id)
 		return nil
 	}
 	return errors.New("disconnect err")
 
 }
 
+// evictIdle disconnects the session idle the longest, false if there is none.
+// slk must be held
+func (e *entity) evictIdle() bool {
+	id, oldest := 0, (*session)(nil)
+	for i, s := range e.sessions {
+		if oldest == nil || s.active.Load() < oldest.active.Load() {
+			id, oldest = i, s
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	close(oldest.stop)
+	e.drop(id)
+	e.logger.Info("evict idle session", "proc", id)
+	return true
+}
+
+// drop forgets the session of id, slk must be held
+func (e *entity) drop(id int) {
+	delete(e.sessions, id)
+	e.proc--
+}
+
 func (e *entity) isConnected(id int) bool {
-	e.lk.RLock()
-	defer e.lk.RUnlock()
+	e.slk.RLock()
+	defer e.slk.RUnlock()
 
 	if _, ok := e.sessions[id]; ok {
 		return true
@@ -117,40 +416,56 @@ func (e *entity) isConnected(id int) bool {
 	return false
 }
 
-func (e *entity) startSession(id int) chan<- Message {
-	out := make(chan Message, 100)
-
-	howlong := clock.New().Timer(0)
-	if !howlong.Stop() {
-		<-howlong.C
-	}
-
-	in := make(chan Message, 100)
-	e.slk.Lock()
-	if _, ok := e.inside[id]; ok {
-		panic("")
+func (e *entity) startSession(id int, s *session) {
+	// no idle timeout leaves idle nil and the session open
+	var (
+		howlong *clock.Timer
+		idle    <-chan time.Time
+	)
+	if e.idleTimeout > 0 {
+		howlong = e.clock.Timer(e.idleTimeout)
+		idle = howlong.C
 	}
-	e.inside[id] = in
-	e.slk.Unlock()
-
-	howlong.Reset(delayDisconnect)
 
 	go func() {
-		defer e.closeConn(id)
+		defer close(s.done)
+		defer e.closeConn(id, s)
+		if howlong != nil {
+			defer howlong.Stop()
+		}
+		close(s.ready)
 		for {
 			select {
-			case m, ok := <-out:
+			case m, ok := <-s.out:
 				if !ok {
 					return
 				}
-				if err := e.handle(m); err != nil {
-					e.sendResp(mes.FailMessage(err), id)
+				start := e.clock.Now()
+				s.active.Store(start.UnixNano())
+				resp, err := e.handle(id, m)
+				if err != nil {
+					e.logger.Warn("close session", "proc", id, "op", m.Op, "err", err)
+					e.sendResp(mes.FailMessage(err).WithID(m.ID), s)
 					return
 				}
-				e.sendResp(mes.SuccessMessage(), id)
-				howlong.Reset(delayDisconnect)
+				e.logger.Debug("handle", "proc", id, "op", m.Op, "key", m.Inside.Key,
+					"id", m.ID, "resp", resp.Op, "latency", e.clock.Since(start))
+				e.sendResp(resp.WithID(m.ID), s)
+				if howlong != nil {
+					if !howlong.Stop() {
+						select {
+						case <-howlong.C:
+						default:
+						}
+					}
+					howlong.Reset(e.idleTimeout)
+				}
+
+			case <-idle:
+				e.logger.Info("close idle session", "proc", id)
+				return
 
-			case <-howlong.C:
+			case <-s.stop:
 				return
 
 			case <-e.ctx.Done():
@@ -158,122 +473,418 @@ func (e *entity) startSession(id int) chan<- Message {
 			}
 		}
 	}()
-	return out
 }
 
 func (e *entity) Len() int {
-	e.lk.RLock()
-	defer e.lk.RUnlock()
+	e.lk.Lock()
+	defer e.lk.Unlock()
 
-	return len(e.vals)
+	e.expire()
+	return e.store.Len()
 }
 
-func (e *entity) closeConn(id int) {
+// closeConn forgets the session if it is still the one of id,
+// after Disconnect the id may already belong to a new session
+func (e *entity) closeConn(id int, s *session) {
 	e.slk.Lock()
 	defer e.slk.Unlock()
 
-	e.proc--
-	delete(e.sessions, id)
-	delete(e.inside, id)
+	if e.sessions[id] != s {
+		return
+	}
+	e.drop(id)
 }
 
-func (e *entity) handle(m Message) error {
+// handle applies the message of the process and returns the response for it.
+// An error means the session can not go on and must be closed
+func (e *entity) handle(id int, m Message) (Message, error) {
 	if m.IsNil() {
-		return errors.New("nil mes")
+		return Message{}, errors.New("nil mes")
 	}
 	switch m.Op {
 	case mes.Add:
-		e.handleAdd(m)
-		return nil
+		return e.handleWrite(id, m, e.handleAdd), nil
 
 	case mes.Delete:
-		e.handleDelete(m)
-		return nil
+		return e.handleWrite(id, m, e.handleDelete), nil
+
+	case mes.CAS:
+		return e.handleCAS(id, m), nil
+
+	case mes.Txn:
+		return e.handleTxn(id, m), nil
+
+	case mes.Batch:
+		return e.handleBatch(id, m), nil
+
+	case mes.Get:
+		return e.handleGet(m), nil
+
+	case mes.Has:
+		return e.handleHas(m), nil
 
 	case mes.Ping:
-		return nil
+		return mes.SuccessMessage(), nil
 	default:
-		return errors.New("undefined mes")
+		return Message{}, errors.New("undefined mes")
 	}
 }
 
-func (e *entity) handleAdd(m Message) {
-	e.add(m.Inside)
+func (e *entity) handleAdd(id int, m Message) error {
+	return e.add(id, m.Seq, e.toStore(m))
 }
 
-func (e *entity) handleDelete(m Message) {
-	e.delete(m.Inside.Key)
+func (e *entity) handleCAS(id int, m Message) Message {
+	in, err := e.cas(id, e.toStore(m), m.Inside.Version)
+	if err != nil {
+		return mes.FailMessage(err)
+	}
+	return mes.ValueMessage(in)
 }
 
-func (e *entity) sendResp(m Message, id int) {
-	e.slk.RLock()
+// toStore makes the value to store from the write request
+func (e *entity) toStore(m Message) Inside {
+	in := m.Inside
+	in.ExpiresAt = time.Time{}
+	if m.TTL > 0 {
+		in.ExpiresAt = e.clock.Now().Add(m.TTL)
+	}
+	return in
+}
 
-	if _, ok := e.inside[id]; !ok {
-		return
+func (e *entity) handleDelete(id int, m Message) error {
+	return e.delete(id, m.Seq, m.Inside.Key)
+}
+
+func (e *entity) handleGet(m Message) Message {
+	in, err := e.get(m.Inside.Key)
+	if err != nil {
+		return mes.FailMessage(err)
 	}
-	e.slk.RUnlock()
+	return mes.ValueMessage(in)
+}
+
+func (e *entity) handleHas(m Message) Message {
+	ok, err := e.has(m.Inside.Key)
+	if err != nil {
+		return mes.FailMessage(err)
+	}
+	if !ok {
+		return mes.FailMessage(ErrNotFound)
+	}
+	return mes.ValueMessage(mes.NewInside(m.Inside.Key, ""))
+}
 
+func (e *entity) sendResp(m Message, s *session) {
 	select {
-	case e.inside[id] <- m:
+	case s.in <- m:
+	case <-s.stop:
 	}
 }
 
 func (e *entity) Resp(id int) Message {
-	ctx, cancel := context.WithTimeout(context.Background(), delayResponse)
-	defer cancel()
+	return e.RespContext(context.Background(), id)
+}
+
+func (e *entity) Done(id int) <-chan struct{} {
+	e.slk.RLock()
+	defer e.slk.RUnlock()
+
+	if s, ok := e.sessions[id]; ok {
+		return s.done
+	}
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+func (e *entity) RespContext(ctx context.Context, id int) Message {
+	// without a session Resp waits for the timeout or ctx
+	var in, stop = make(chan Message), make(chan struct{})
+	e.slk.RLock()
+	if s, ok := e.sessions[id]; ok {
+		in, stop = s.in, s.stop
+	}
+	e.slk.RUnlock()
+
+	timeout := e.clock.Timer(e.respTimeout)
+	defer timeout.Stop()
+
 	select {
-	case m := <-e.inside[id]:
-		log.Println("resp")
+	case m := <-in:
 		return m
+	case <-stop:
+		return mes.Message{}
+	case <-timeout.C:
+		return mes.Message{}
 	case <-ctx.Done():
 		return mes.Message{}
 	}
 
 }
 
-func (e *entity) add(in Inside) {
+// add writes in on behalf of the process proc, seq is logged with the write
+func (e *entity) add(proc int, seq uint64, in Inside) error {
 	e.lk.Lock()
 	defer e.lk.Unlock()
 
-	e.vals[in.Key] = in
+	_, err := e.put(proc, seq, mes.Add, in)
+	return err
 }
 
-func (e *entity) get(key string) Inside {
-	e.lk.RLock()
-	defer e.lk.RUnlock()
+// cas writes in only if the key has the expected version, 0 means the key must not exist
+func (e *entity) cas(proc int, in Inside, expected uint64) (Inside, error) {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+
+	old, err := e.current(in.Key)
+	if err != nil {
+		return Inside{}, err
+	}
+	if old.Version != expected {
+		return Inside{}, ErrVersionMismatch
+	}
+	return e.put(proc, 0, mes.CAS, in)
+}
 
-	if val, ok := e.vals[key]; ok {
-		return val
+// put writes in with the next version of the key, e.lk must be held
+func (e *entity) put(proc int, seq uint64, op mes.Op, in Inside) (Inside, error) {
+	old, err := e.current(in.Key)
+	if err != nil {
+		return Inside{}, err
 	}
+	in.Version = e.nextVersion(in.Key, old, e.floor)
 
-	return Inside{}
+	if e.wal != nil {
+		if err := e.wal.append(walOp{op: mes.Add, in: in, proc: proc, seq: seq}); err != nil {
+			return Inside{}, err
+		}
+	}
+	if err := e.apply(walOp{op: mes.Add, in: in}); err != nil {
+		return Inside{}, err
+	}
+	e.notify(Event{
+		Key:     in.Key,
+		Op:      op,
+		Old:     old,
+		New:     in,
+		Version: in.Version,
+		Proc:    proc,
+	})
+	return in, nil
 }
 
-func (e *entity) has(key string) bool {
+// apply the logged op to the store and the expiry wheel, e.lk must be held
+func (e *entity) apply(o walOp) error {
+	switch o.op {
+	case mes.Add:
+		if err := e.store.Put(o.in); err != nil {
+			return err
+		}
+		if o.in.ExpiresAt.IsZero() {
+			e.expiry.cancel(o.in.Key)
+		} else {
+			e.expiry.schedule(o.in.Key, o.in.ExpiresAt)
+		}
+		return nil
+
+	case mes.Delete:
+		e.expiry.cancel(o.in.Key)
+		e.retire(o.in)
+		return e.store.Delete(o.in.Key)
+
+	default:
+		return fmt.Errorf("can not apply op %d", o.op)
+	}
+}
+
+// retire raises the floor to the version of the key that is removed,
+// del has the version the key had when the log record was written
+func (e *entity) retire(del Inside) {
+	if del.Version > e.floor {
+		e.floor = del.Version
+	}
+	if in, err := e.store.Get(del.Key); err == nil && in.Version > e.floor {
+		e.floor = in.Version
+	}
+}
+
+// nextVersion of the key with the current value old above floor, e.lk must be held.
+// A removed or expired key goes on above every version removed before,
+// so a CAS with the version of the old key can not succeed
+func (e *entity) nextVersion(key string, old Inside, floor uint64) uint64 {
+	if old.Key != "" {
+		return old.Version + 1
+	}
+	// the key may still be in the store after its deadline
+	if in, err := e.store.Get(key); err == nil && in.Version > floor {
+		floor = in.Version
+	}
+	return floor + 1
+}
+
+// current value of the key, zero if there is no such key
+func (e *entity) current(key string) (Inside, error) {
+	in, err := e.lookup(key)
+	switch err {
+	case nil:
+		return in, nil
+	case ErrNotFound:
+		return Inside{}, nil
+	default:
+		return Inside{}, err
+	}
+}
+
+func (e *entity) get(key string) (Inside, error) {
 	e.lk.RLock()
 	defer e.lk.RUnlock()
 
-	if _, ok := e.vals[key]; ok {
-		return true
+	return e.lookup(key)
+}
+
+// lookup the key that is not expired, e.lk must be held
+func (e *entity) lookup(key string) (Inside, error) {
+	in, err := e.store.Get(key)
+	if err != nil {
+		return Inside{}, err
 	}
-	return false
+	// the wheel may not have got to the key yet
+	if in.Expired(e.clock.Now()) {
+		return Inside{}, ErrNotFound
+	}
+	return in, nil
+}
+
+func (e *entity) has(key string) (bool, error) {
+	_, err := e.get(key)
+	switch err {
+	case nil:
+		return true, nil
+	case ErrNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// delete the key on behalf of the process proc, seq is logged with the write
+func (e *entity) delete(proc int, seq uint64, key string) error {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+
+	return e.remove(proc, seq, key)
 }
 
-func (e *entity) delete(key string) {
+// remove the key on behalf of the process proc, e.lk must be held
+func (e *entity) remove(proc int, seq uint64, key string) error {
+	old, err := e.current(key)
+	if err != nil {
+		return err
+	}
+	// the removed version is logged for the floor
+	del := mes.NewInside(key, "")
+	del.Version = old.Version
+	if e.wal != nil {
+		if err := e.wal.append(walOp{op: mes.Delete, in: del, proc: proc, seq: seq}); err != nil {
+			return err
+		}
+	}
+	if err := e.apply(walOp{op: mes.Delete, in: del}); err != nil {
+		return err
+	}
+	if old.Key != "" {
+		e.notify(Event{
+			Key:     key,
+			Op:      mes.Delete,
+			Old:     old,
+			Version: old.Version,
+			Proc:    proc,
+		})
+	}
+	return nil
+}
+
+func (e *entity) expireLoop() {
+	ticker := e.clock.Ticker(expiryTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.lk.Lock()
+			e.expire()
+			e.lk.Unlock()
+
+			e.qlk.Lock()
+			e.seqs.prune(e.clock.Now())
+			e.qlk.Unlock()
+
+		case <-e.ctx.Done():
+			return
+		}
+	}
+}
+
+// expire removes the keys whose time has come, e.lk must be held.
+// Expired keys are not logged, their deadline is in the data and they are dropped again on replay
+func (e *entity) expire() {
+	e.expiry.advance(e.clock.Now(), func(key string) {
+		old, err := e.store.Get(key)
+		if err != nil {
+			e.logger.Error("expire", "key", key, "err", err)
+			return
+		}
+		if old.Version > e.floor {
+			e.floor = old.Version
+		}
+		if err := e.store.Delete(key); err != nil {
+			e.logger.Error("expire", "key", key, "err", err)
+			return
+		}
+		e.notify(Event{
+			Key:     key,
+			Op:      mes.Delete,
+			Old:     old,
+			Version: old.Version,
+			Proc:    NoProc,
+			Expired: true,
+		})
+	})
+}
+
+// scheduleExpiry puts the loaded keys with a deadline on the wheel
+func (e *entity) scheduleExpiry() error {
 	e.lk.Lock()
 	defer e.lk.Unlock()
 
-	delete(e.vals, key)
+	err := e.store.Iterate(func(in Inside) bool {
+		if !in.ExpiresAt.IsZero() {
+			e.expiry.schedule(in.Key, in.ExpiresAt)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	e.expire()
+	return nil
 }
 
 func (e *entity) String() string {
-	e.lk.RLock()
-	defer e.lk.RUnlock()
+	e.lk.Lock()
+	defer e.lk.Unlock()
+
+	e.expire()
 
 	res := ""
-	for key, in := range e.vals {
-		val := fmt.Sprintf("key: %s, data: %s \n", key, in.Data)
+	err := e.store.Iterate(func(in Inside) bool {
+		val := fmt.Sprintf("key: %s, data: %s \n", in.Key, in.Data)
 		res += val
+		return true
+	})
+	if err != nil {
+		res += fmt.Sprintf("iterate: %s \n", err)
 	}
 	return res
 }
@@ -1,12 +1,16 @@
 package entity
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/benbjohnson/clock"
 	mes "github.com/qwertyqq2/entity/message"
 )
 
@@ -53,6 +57,21 @@ func (p *proc) Send(m Message, e Entity) error {
 	}
 }
 
+func (p *proc) Request(m Message, e Entity) (Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), delayRequest)
+	defer cancel()
+	select {
+	case p.conn <- m:
+		resp := e.Resp(p.id)
+		if resp.IsNil() {
+			return resp, errors.New("nil response")
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return Message{}, errors.New("timeout")
+	}
+}
+
 const (
 	procLimit = 2
 )
@@ -173,19 +192,462 @@ func TestSendDelete(t *testing.T) {
 
 }
 
-func TestTimeout(t *testing.T) {
+func TestSendGet(t *testing.T) {
 	constructor()
 
 	if err := proc1.Connect(ent); err != nil {
 		t.Fatal(err)
 	}
 
-	time.Sleep(delayDisconnect)
-	msg1 := mes.AddMessage("n1", "is n1")
-	if err := proc1.Send(msg1, ent); err == nil {
-		t.Fatal("timeout not working")
+	if err := proc1.Send(mes.AddMessage("n1", "is n1"), ent); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := proc1.Request(mes.GetMessage("n1"), ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.IsSuccess() || resp.Inside.Data != "is n1" {
+		t.Fatal("wrong value", resp.Inside)
+	}
+
+	resp, err = proc1.Request(mes.GetMessage("n2"), ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error() != ErrNotFound {
+		t.Fatal("expected not found", resp)
+	}
+
+	// session is still alive after not found
+	if err := proc1.Send(mes.PingMessage(), ent); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendHas(t *testing.T) {
+	constructor()
+
+	if err := proc1.Connect(ent); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := proc1.Send(mes.AddMessage("n1", "is n1"), ent); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := proc1.Request(mes.HasMessage("n1"), ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.IsSuccess() {
+		t.Fatal("key must exist")
+	}
+
+	if err := proc1.Send(mes.DeleteMessage("n1"), ent); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = proc1.Request(mes.HasMessage("n1"), ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error() != ErrNotFound {
+		t.Fatal("key must be deleted")
+	}
+}
+
+func TestSendCAS(t *testing.T) {
+	constructor()
+
+	if err := proc1.Connect(ent); err != nil {
+		t.Fatal(err)
+	}
+
+	// 0 means the key must not exist
+	resp, err := proc1.Request(mes.CASMessage("n1", "is n1", 0), ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.IsSuccess() || resp.Inside.Version != 1 {
+		t.Fatal("wrong version", resp)
+	}
+
+	if err := proc1.Send(mes.AddMessage("n1", "is n1 again"), ent); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = proc1.Request(mes.CASMessage("n1", "stale", 1), ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error() != ErrVersionMismatch {
+		t.Fatal("expected version mismatch", resp)
+	}
+
+	resp, err = proc1.Request(mes.CASMessage("n1", "fresh", 2), ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.IsSuccess() || resp.Inside.Version != 3 {
+		t.Fatal("wrong version", resp)
+	}
+
+	resp, err = proc1.Request(mes.GetMessage("n1"), ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Inside.Data != "fresh" || resp.Inside.Version != 3 {
+		t.Fatal("wrong value", resp.Inside)
+	}
+}
+
+func TestSendSeq(t *testing.T) {
+	constructor()
+
+	if err := proc1.Connect(ent); err != nil {
+		t.Fatal(err)
+	}
+	get := func(key string) Inside {
+		resp, err := proc1.Request(mes.GetMessage(key), ent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Inside
+	}
+
+	resp, err := proc1.Request(mes.AddMessage("s1", "new s1").WithSeq(1, 2), ent)
+	if err != nil || !resp.IsSuccess() {
+		t.Fatal("add failed", resp, err)
+	}
+	// a duplicate and an older write are answered but not applied
+	for _, m := range []Message{
+		mes.AddMessage("s1", "new s1").WithSeq(1, 2),
+		mes.AddMessage("s1", "old s1").WithSeq(1, 1),
+		mes.DeleteMessage("s1").WithSeq(1, 1),
+	} {
+		resp, err := proc1.Request(m, ent)
+		if err != nil || !resp.IsSuccess() {
+			t.Fatal("write failed", resp, err)
+		}
+	}
+	if in := get("s1"); in.Data != "new s1" || in.Version != 1 {
+		t.Fatal("wrong value", in)
+	}
+
+	// the sequences are kept for every key and outlive the session
+	if err := proc1.Disconnect(ent); err != nil {
+		t.Fatal(err)
+	}
+	if err := proc1.Connect(ent); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []Message{
+		mes.AddMessage("s2", "is s2").WithSeq(1, 1),
+		mes.AddMessage("s1", "old s1").WithSeq(1, 2),
+		mes.AddMessage("s1", "newer s1").WithSeq(1, 3),
+		mes.AddMessage("s1", "no seq s1"),
+	} {
+		if _, err := proc1.Request(m, ent); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if in := get("s2"); in.Data != "is s2" {
+		t.Fatal("wrong value", in)
+	}
+	if in := get("s1"); in.Data != "no seq s1" || in.Version != 3 {
+		t.Fatal("wrong value", in)
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	mock := clock.NewMock()
+	e := newEntity(procLimit, WithClock(mock), DedupWindow(time.Minute))
+	defer e.Shutdown()
+
+	write := func(m Message) {
+		if resp := e.handleWrite(1, m, e.handleAdd); !resp.IsSuccess() {
+			t.Fatal("write failed", resp)
+		}
+	}
+	kept := func() int {
+		e.qlk.Lock()
+		defer e.qlk.Unlock()
+
+		e.seqs.prune(mock.Now())
+		return len(e.seqs.last[1])
+	}
+
+	write(mes.AddMessage("w1", "is w1").WithSeq(1, 1))
+	mock.Add(30 * time.Second)
+	write(mes.AddMessage("w2", "is w2").WithSeq(1, 2))
+	if err := e.delete(0, 0, "w1"); err != nil {
+		t.Fatal(err)
+	}
+	// the removed key keeps its sequence for the window
+	write(mes.AddMessage("w1", "is w1").WithSeq(1, 1))
+	if ok, _ := e.has("w1"); ok {
+		t.Fatal("resend is applied")
+	}
+	if n := kept(); n != 2 {
+		t.Fatal("wrong kept sequences", n)
+	}
+
+	mock.Add(30 * time.Second)
+	if n := kept(); n != 1 {
+		t.Fatal("wrong kept sequences", n)
+	}
+	mock.Add(30 * time.Second)
+	if n := kept(); n != 0 {
+		t.Fatal("wrong kept sequences", n)
+	}
+	e.qlk.Lock()
+	_, ok := e.seqs.last[1]
+	e.qlk.Unlock()
+	if ok {
+		t.Fatal("the process is kept")
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	constructor()
+
+	if err := proc1.Connect(ent); err != nil {
+		t.Fatal(err)
+	}
+	if err := proc1.Send(mes.AddMessage("b3", "is b3"), ent); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := proc1.Request(mes.BatchMessage(
+		mes.AddMessage("b1", "is b1").WithSeq(1, 1),
+		mes.AddMessage("b2", "is b2").WithSeq(1, 2),
+		mes.GetMessage("b1"),
+		mes.DeleteMessage("b3").WithSeq(1, 3),
+		// a duplicate
+		mes.AddMessage("b1", "old b1").WithSeq(1, 1),
+	), ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.IsSuccess() || len(resp.Ops) != 5 {
+		t.Fatal("wrong response", resp)
+	}
+	for i, r := range resp.Ops {
+		if i == 2 {
+			if r.Error() != ErrBatchOp {
+				t.Fatal("expected batch op error", r)
+			}
+			continue
+		}
+		if !r.IsSuccess() {
+			t.Fatal("wrong result", i, r)
+		}
+	}
+	if ent.Len() != 2 {
+		t.Fatal("wrong len", ent.Len())
+	}
+	resp, err = proc1.Request(mes.GetMessage("b1"), ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Inside.Data != "is b1" || resp.Inside.Version != 1 {
+		t.Fatal("wrong value", resp.Inside)
+	}
+}
+
+func TestRespID(t *testing.T) {
+	constructor()
+
+	if err := proc1.Connect(ent); err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range []Message{
+		mes.AddMessage("r1", "is r1").WithID(1),
+		mes.GetMessage("r1").WithID(2),
+		mes.GetMessage("r2").WithID(3),
+		mes.BatchMessage(mes.DeleteMessage("r1")).WithID(4),
+		// closes the session
+		{ID: 5},
+	} {
+		resp, err := proc1.Request(m, ent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ID != uint64(i+1) {
+			t.Fatal("wrong id", resp)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	mock := clock.NewMock()
+	e := newEntity(procLimit, WithClock(mock))
+	defer e.Shutdown()
+	proc1 = newProc(1)
+
+	if err := proc1.Connect(e); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.Add(delayDisconnect)
+	waitDisconnected(t, e, 1)
+
+}
+
+// waitDisconnected waits until the session of id is closed
+func waitDisconnected(t *testing.T, e *entity, id int) {
+	deadline := time.Now().Add(delayRequest)
+	for e.isConnected(id) {
+		if time.Now().After(deadline) {
+			t.Fatal("still connected", id)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	mock := clock.NewMock()
+	e := newEntity(procLimit, WithClock(mock), IdleTimeout(time.Second))
+	defer e.Shutdown()
+
+	p := newProc(1)
+	if err := p.Connect(e); err != nil {
+		t.Fatal(err)
+	}
+	mock.Add(500 * time.Millisecond)
+	if err := p.Send(mes.AddMessage("n1", "is n1"), e); err != nil {
+		t.Fatal(err)
+	}
+
+	// the message has moved the timeout
+	mock.Add(700 * time.Millisecond)
+	if !e.isConnected(1) {
+		t.Fatal("disconnected before the timeout")
+	}
+	mock.Add(300 * time.Millisecond)
+	waitDisconnected(t, e, 1)
+
+	// no timeout keeps the session
+	e = newEntity(procLimit, WithClock(mock), IdleTimeout(0))
+	defer e.Shutdown()
+	if err := p.Connect(e); err != nil {
+		t.Fatal(err)
+	}
+	mock.Add(2 * delayDisconnect)
+	time.Sleep(50 * time.Millisecond)
+	if !e.isConnected(1) {
+		t.Fatal("disconnected without timeout")
+	}
+}
+
+func TestResponseTimeout(t *testing.T) {
+	e := New(procLimit, ResponseTimeout(50*time.Millisecond))
+	defer e.Shutdown()
+
+	p := newProc(1)
+	if err := p.Connect(e); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if resp := e.Resp(1); !resp.IsNil() {
+		t.Fatal("response without message", resp)
+	}
+	if d := time.Since(now); d > time.Second {
+		t.Fatal("waited too long", d)
+	}
+}
+
+func TestSessionBuffer(t *testing.T) {
+	e := New(procLimit, SessionBuffer(3))
+	defer e.Shutdown()
+
+	p := newProc(1)
+	if err := p.Connect(e); err != nil {
+		t.Fatal(err)
+	}
+	// 3 responses fill their channel, the session blocks on the 4th
+	// and 3 more messages fill the session channel
+	for i := 0; i < 7; i++ {
+		select {
+		case p.conn <- mes.AddMessage(fmt.Sprint("n", i), "is n"):
+		case <-time.After(delayRequest):
+			t.Fatal("buffer is full", i)
+		}
+	}
+	select {
+	case p.conn <- mes.AddMessage("n7", "is n7"):
+		t.Fatal("buffer is larger")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if e.Len() != 4 {
+		t.Fatal("wrong len", e.Len())
+	}
+}
+
+func TestProcLimitPolicy(t *testing.T) {
+	e := New(procLimit)
+	defer e.Shutdown()
+	for id := 1; id <= procLimit; id++ {
+		if err := newProc(id).Connect(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := newProc(3).Connect(e); !errors.Is(err, ErrProcLimit) {
+		t.Fatal("expected limit", err)
+	}
+
+	mock := clock.NewMock()
+	ev := newEntity(procLimit, WithClock(mock), ProcLimitPolicy(EvictIdle))
+	defer ev.Shutdown()
+
+	p1, p2 := newProc(1), newProc(2)
+	if err := p1.Connect(ev); err != nil {
+		t.Fatal(err)
+	}
+	mock.Add(time.Second)
+	if err := p2.Connect(ev); err != nil {
+		t.Fatal(err)
+	}
+	mock.Add(time.Second)
+	if err := p1.Send(mes.AddMessage("n1", "is n1"), ev); err != nil {
+		t.Fatal(err)
+	}
+
+	// p2 is idle the longest
+	if err := newProc(3).Connect(ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.isConnected(2) || !ev.isConnected(1) || !ev.isConnected(3) {
+		t.Fatal("wrong session evicted")
+	}
+	if err := p1.Send(mes.AddMessage("n2", "is n2"), ev); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	if newEntity(procLimit).logger.Enabled(context.Background(), slog.LevelError) {
+		t.Fatal("logger is not silent by default")
 	}
 
+	var out bytes.Buffer
+	e := New(procLimit, WithLogger(slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+	defer e.Shutdown()
+
+	p := newProc(1)
+	if err := p.Connect(e); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Send(mes.AddMessage("n1", "is n1"), e); err != nil {
+		t.Fatal(err)
+	}
+	// the record is written before the response
+	for _, field := range []string{`"msg":"handle"`, `"proc":1`, `"op":"add"`, `"key":"n1"`, `"latency":`} {
+		if !strings.Contains(out.String(), field) {
+			t.Fatal("no field", field, out.String())
+		}
+	}
 }
 
 func TestEntry(t *testing.T) {
@@ -0,0 +1,126 @@
+package entity
+
+import "time"
+
+const (
+	expiryTick  = 100 * time.Millisecond
+	expirySlots = 512
+)
+
+// Hashed timer wheel of key deadlines.
+// A key sits in the slot of the tick its deadline falls into,
+// deadlines further than one turn are moved forward each time their slot is visited
+type wheel struct {
+	tick  time.Duration
+	slots []map[string]struct{}
+	pos   int
+	// end of the tick of the slot at pos
+	at time.Time
+
+	timers map[string]timer
+}
+
+type timer struct {
+	deadline time.Time
+	slot     int
+}
+
+func newWheel(tick time.Duration, size int, now time.Time) *wheel {
+	slots := make([]map[string]struct{}, size)
+	for i := range slots {
+		slots[i] = make(map[string]struct{})
+	}
+	return &wheel{
+		tick:   tick,
+		slots:  slots,
+		at:     now,
+		timers: make(map[string]timer),
+	}
+}
+
+func (w *wheel) Len() int {
+	return len(w.timers)
+}
+
+func (w *wheel) schedule(key string, deadline time.Time) {
+	w.cancel(key)
+	w.place(key, deadline)
+}
+
+func (w *wheel) cancel(key string) {
+	t, ok := w.timers[key]
+	if !ok {
+		return
+	}
+	delete(w.timers, key)
+	delete(w.slots[t.slot], key)
+}
+
+// advance the wheel to now and call fn for every key whose deadline has come
+func (w *wheel) advance(now time.Time, fn func(key string)) {
+	for steps := 0; !w.at.Add(w.tick).After(now); steps++ {
+		if steps == len(w.slots) {
+			// a whole turn is visited, all due keys are gone
+			w.at = now
+			w.replace()
+			break
+		}
+		w.at = w.at.Add(w.tick)
+		w.pos = (w.pos + 1) % len(w.slots)
+		w.visit(w.pos, now, fn)
+	}
+	// the current tick is not over, but some of its keys may be due already
+	w.visit((w.pos+1)%len(w.slots), now, fn)
+}
+
+func (w *wheel) visit(pos int, now time.Time, fn func(key string)) {
+	slot := w.slots[pos]
+	for key := range slot {
+		t := w.timers[key]
+		if t.deadline.After(now) {
+			if w.slotOf(t.deadline) != pos {
+				delete(slot, key)
+				w.place(key, t.deadline)
+			}
+			continue
+		}
+		delete(slot, key)
+		delete(w.timers, key)
+		fn(key)
+	}
+}
+
+// replace all keys relative to the current position
+func (w *wheel) replace() {
+	for _, slot := range w.slots {
+		for key := range slot {
+			delete(slot, key)
+		}
+	}
+	for key, t := range w.timers {
+		w.place(key, t.deadline)
+	}
+}
+
+func (w *wheel) place(key string, deadline time.Time) {
+	slot := w.slotOf(deadline)
+	w.slots[slot][key] = struct{}{}
+	w.timers[key] = timer{deadline: deadline, slot: slot}
+}
+
+func (w *wheel) slotOf(deadline time.Time) int {
+	ticks := w.ticks(deadline)
+	if ticks >= len(w.slots) {
+		ticks = len(w.slots) - 1
+	}
+	return (w.pos + ticks) % len(w.slots)
+}
+
+// ticks from pos to the slot of the deadline, at least one
+func (w *wheel) ticks(deadline time.Time) int {
+	d := deadline.Sub(w.at)
+	if d <= 0 {
+		return 1
+	}
+	return int((d + w.tick - 1) / w.tick)
+}
@@ -0,0 +1,176 @@
+package entity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	mes "github.com/qwertyqq2/entity/message"
+)
+
+func TestWheel(t *testing.T) {
+	now := time.Unix(0, 0)
+	w := newWheel(time.Second, 8, now)
+
+	w.schedule("a", now.Add(1500*time.Millisecond))
+	w.schedule("b", now.Add(3*time.Second))
+	// longer than one turn of the wheel
+	w.schedule("c", now.Add(20*time.Second))
+	w.schedule("d", now.Add(2*time.Second))
+	w.cancel("d")
+
+	expired := make([]string, 0)
+	fn := func(key string) {
+		expired = append(expired, key)
+	}
+
+	w.advance(now.Add(time.Second), fn)
+	if len(expired) != 0 {
+		t.Fatal("expired too early", expired)
+	}
+
+	// in the middle of a tick
+	w.advance(now.Add(1600*time.Millisecond), fn)
+	if len(expired) != 1 || expired[0] != "a" {
+		t.Fatal("a must expire", expired)
+	}
+
+	w.advance(now.Add(19*time.Second), fn)
+	if len(expired) != 2 || expired[1] != "b" {
+		t.Fatal("b must expire", expired)
+	}
+	if w.Len() != 1 {
+		t.Fatal("wrong len", w.Len())
+	}
+
+	w.advance(now.Add(20*time.Second), fn)
+	if len(expired) != 3 || expired[2] != "c" {
+		t.Fatal("c must expire", expired)
+	}
+}
+
+func TestWheelJump(t *testing.T) {
+	now := time.Unix(0, 0)
+	w := newWheel(time.Second, 4, now)
+
+	w.schedule("a", now.Add(2*time.Second))
+	w.schedule("b", now.Add(100*time.Second))
+	w.schedule("c", now.Add(101*time.Second))
+
+	expired := make([]string, 0)
+	fn := func(key string) {
+		expired = append(expired, key)
+	}
+
+	// far more than a turn
+	w.advance(now.Add(100*time.Second), fn)
+	sort.Strings(expired)
+	if len(expired) != 2 || expired[0] != "a" || expired[1] != "b" {
+		t.Fatal("wrong expired", expired)
+	}
+
+	w.advance(now.Add(101*time.Second), fn)
+	if len(expired) != 3 {
+		t.Fatal("c must expire", expired)
+	}
+}
+
+func TestAddWithTTL(t *testing.T) {
+	mock := clock.NewMock()
+	ent := New(procLimit, WithClock(mock))
+	defer ent.Shutdown()
+
+	p := newProc(1)
+	if err := p.Connect(ent); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []Message{
+		mes.AddWithTTLMessage("short", "lives a second", time.Second),
+		mes.AddWithTTLMessage("long", "lives a minute", time.Minute),
+		mes.AddMessage("forever", "lives forever"),
+	} {
+		if err := p.Send(m, ent); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ent.Len() != 3 {
+		t.Fatal("wrong len", ent.Len())
+	}
+
+	mock.Add(time.Second)
+	if ent.Len() != 2 {
+		t.Fatal("short must expire", ent.Len())
+	}
+	resp, err := p.Request(mes.GetMessage("short"), ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error() != ErrNotFound {
+		t.Fatal("expired key is visible", resp)
+	}
+
+	// overwrite without ttl keeps the key
+	if err := p.Send(mes.AddMessage("long", "now forever"), ent); err != nil {
+		t.Fatal(err)
+	}
+	mock.Add(time.Minute)
+	if ent.Len() != 2 {
+		t.Fatal("wrong keys", ent.String())
+	}
+}
+
+func TestExpiryReplay(t *testing.T) {
+	dir := t.TempDir()
+	mock := clock.NewMock()
+
+	ent, err := Open(dir, procLimit, WithClock(mock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := ent.(*entity)
+	if err := e.handleAdd(0, mes.AddWithTTLMessage("n1", "is n1", time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.handleAdd(0, mes.AddWithTTLMessage("n2", "is n2", time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	ent.Shutdown()
+
+	mock.Add(2 * time.Second)
+	ent, err = Open(dir, procLimit, WithClock(mock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ent.Shutdown()
+	if ent.Len() != 1 {
+		t.Fatal("wrong len", ent.Len())
+	}
+
+	mock.Add(time.Minute)
+	if ent.Len() != 0 {
+		t.Fatal("n2 must expire after replay", ent.Len())
+	}
+}
+
+func TestRestoreSnapshotV1(t *testing.T) {
+	buf := []byte(snapshotMagic)
+	buf = binary.LittleEndian.AppendUint16(buf, 1)
+	buf = binary.AppendUvarint(buf, 1)
+	buf = appendString(buf, "n1")
+	buf = appendString(buf, "is n1")
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+
+	ent, err := Restore(bytes.NewReader(buf), procLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ent.Shutdown()
+	if in, _ := ent.(*entity).get("n1"); in.Data != "is n1" || !in.ExpiresAt.IsZero() {
+		t.Fatal("wrong value", in)
+	}
+}
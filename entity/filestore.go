@@ -0,0 +1,163 @@
+package entity
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	mes "github.com/qwertyqq2/entity/message"
+)
+
+// Store that keeps values in an append-only file and only the offsets in memory.
+// Records have the log format, a Delete is written as a tombstone.
+// Overwritten values are not reclaimed, the file grows with every write
+type FileStore struct {
+	f     *os.File
+	sync  bool
+	index map[string]fileRecord
+	size  int64
+	buf   []byte
+}
+
+type fileRecord struct {
+	offset int64
+	size   int64
+}
+
+// OpenFileStore opens or creates the store file at path.
+// With sync every write is fsynced before it returns
+func OpenFileStore(path string, sync bool) (*FileStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileStore{
+		f:     f,
+		sync:  sync,
+		index: make(map[string]fileRecord),
+	}
+	if err := s.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load builds the index, a torn tail is cut off like in the log
+func (s *FileStore) load() error {
+	st, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(s.f)
+	for {
+		payload, n, err := readRecord(r, st.Size()-s.size)
+		if err == io.EOF {
+			break
+		}
+		if tornTail(err, s.size, n, st.Size()) {
+			if err := s.f.Truncate(s.size); err != nil {
+				return err
+			}
+			break
+		}
+		if err == ErrCorruptLog {
+			return fmt.Errorf("%w at offset %d", err, s.size)
+		}
+		if err != nil {
+			return err
+		}
+		o, err := decodeOp(payload)
+		if err != nil {
+			return err
+		}
+
+		switch o.op {
+		case mes.Add:
+			s.index[o.in.Key] = fileRecord{offset: s.size, size: n}
+		case mes.Delete:
+			delete(s.index, o.in.Key)
+		}
+		s.size += n
+	}
+	return nil
+}
+
+func (s *FileStore) Get(key string) (Inside, error) {
+	rec, ok := s.index[key]
+	if !ok {
+		return Inside{}, ErrNotFound
+	}
+	payload, _, err := readRecord(io.NewSectionReader(s.f, rec.offset, rec.size), rec.size)
+	if err != nil {
+		return Inside{}, err
+	}
+	o, err := decodeOp(payload)
+	return o.in, err
+}
+
+func (s *FileStore) Put(in Inside) error {
+	n, err := s.append(mes.Add, in)
+	if err != nil {
+		return err
+	}
+	s.index[in.Key] = fileRecord{offset: s.size - n, size: n}
+	return nil
+}
+
+func (s *FileStore) Delete(key string) error {
+	if _, ok := s.index[key]; !ok {
+		return nil
+	}
+	if _, err := s.append(mes.Delete, mes.NewInside(key, "")); err != nil {
+		return err
+	}
+	delete(s.index, key)
+	return nil
+}
+
+func (s *FileStore) Iterate(fn func(in Inside) bool) error {
+	for key := range s.index {
+		in, err := s.Get(key)
+		if err != nil {
+			return err
+		}
+		if !fn(in) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// The file outlives the entity, see DurableStore
+func (s *FileStore) Durable() bool {
+	return true
+}
+
+func (s *FileStore) Len() int {
+	return len(s.index)
+}
+
+func (s *FileStore) Close() error {
+	if err := s.f.Sync(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
+
+func (s *FileStore) append(op mes.Op, in Inside) (int64, error) {
+	s.buf = appendRecord(s.buf[:0], walOp{op: op, in: in})
+	if _, err := s.f.WriteAt(s.buf, s.size); err != nil {
+		return 0, err
+	}
+	if s.sync {
+		if err := s.f.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	n := int64(len(s.buf))
+	s.size += n
+	return n, nil
+}
@@ -0,0 +1,287 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mes "github.com/qwertyqq2/entity/message"
+	"github.com/qwertyqq2/entity/process"
+)
+
+const (
+	keysPath = "/keys/"
+	bulkPath = "/keys"
+
+	MaxBodySize = 4 << 20
+)
+
+var ErrEmptyPool = errors.New("pool of processes is empty")
+
+// Handler serves the entity over HTTP with JSON.
+//
+//	PUT    /keys/{key}   body is the data, ?ttl=1m drops it after ttl
+//	DELETE /keys/{key}
+//	GET    /keys/{key}   {"key", "data", "version", "expires_at"}
+//	POST   /keys         [{"op": "put" | "delete", "key", "data", "ttl"}]
+//	GET    /stats
+//
+// Writes go to the process queues and are answered with 202 before the entity has them.
+// A key is always written by the same process of the pool so its writes keep their order
+type Handler struct {
+	ent   process.Transport
+	procs []process.Process
+	mux   *http.ServeMux
+
+	puts    atomic.Int64
+	deletes atomic.Int64
+	gets    atomic.Int64
+	errs    atomic.Int64
+}
+
+type Value struct {
+	Key       string     `json:"key"`
+	Data      string     `json:"data"`
+	Version   uint64     `json:"version"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type Write struct {
+	Op   string `json:"op"`
+	Key  string `json:"key"`
+	Data string `json:"data,omitempty"`
+	TTL  string `json:"ttl,omitempty"`
+}
+
+type Stats struct {
+	Processes int   `json:"processes"`
+	Keys      *int  `json:"keys,omitempty"`
+	Puts      int64 `json:"puts"`
+	Deletes   int64 `json:"deletes"`
+	Gets      int64 `json:"gets"`
+	Errors    int64 `json:"errors"`
+}
+
+// New starts size processes with ids from firstID on ent and serves them.
+// The entity must allow that many processes
+func New(ent process.Transport, firstID, size int, opts ...process.Option) (*Handler, error) {
+	if size <= 0 {
+		return nil, ErrEmptyPool
+	}
+	h := &Handler{
+		ent: ent,
+		mux: http.NewServeMux(),
+	}
+	for i := 0; i < size; i++ {
+		p, err := process.WithEntity(firstID+i, ent, opts...)
+		if err != nil {
+			process.Shutdown(h.procs...)
+			return nil, err
+		}
+		h.procs = append(h.procs, p)
+	}
+
+	h.mux.HandleFunc(keysPath, h.handleKey)
+	h.mux.HandleFunc(bulkPath, h.handleBulk)
+	h.mux.HandleFunc("/stats", h.handleStats)
+	return h, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Close sends the accepted writes and closes the processes of the pool, the entity stays open.
+// The processes are closed even if ctx is done first
+func (h *Handler) Close(ctx context.Context) error {
+	var err error
+	for _, p := range h.procs {
+		if cerr := p.Close(ctx); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// proc returns the process that owns the key
+func (h *Handler) proc(key string) process.Process {
+	f := fnv.New32a()
+	f.Write([]byte(key))
+	return h.procs[f.Sum32()%uint32(len(h.procs))]
+}
+
+func (h *Handler) handleKey(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, keysPath)
+	if key == "" {
+		h.fail(w, http.StatusBadRequest, errors.New("empty key"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.get(w, key)
+
+	case http.MethodPut:
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxBodySize))
+		if err != nil {
+			h.fail(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		wr := Write{Op: "put", Key: key, Data: string(data), TTL: r.URL.Query().Get("ttl")}
+		if err := h.write(wr); err != nil {
+			h.fail(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+
+	case http.MethodDelete:
+		h.write(Write{Op: "delete", Key: key})
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		h.fail(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func (h *Handler) get(w http.ResponseWriter, key string) {
+	h.gets.Add(1)
+	in, err := h.proc(key).Get(key)
+	switch err {
+	case nil:
+	case process.ErrNotFound:
+		h.fail(w, http.StatusNotFound, err)
+		return
+	case process.ErrTimeoutSend:
+		h.fail(w, http.StatusGatewayTimeout, err)
+		return
+	default:
+		h.fail(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newValue(in))
+}
+
+func newValue(in mes.Inside) Value {
+	v := Value{Key: in.Key, Data: in.Data, Version: in.Version}
+	if !in.ExpiresAt.IsZero() {
+		v.ExpiresAt = &in.ExpiresAt
+	}
+	return v
+}
+
+// handleBulk queues all writes of the body, nothing is queued if one of them is bad
+func (h *Handler) handleBulk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		h.fail(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	var writes []Write
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxBodySize)).Decode(&writes); err != nil {
+		h.fail(w, http.StatusBadRequest, err)
+		return
+	}
+	for _, wr := range writes {
+		if err := wr.validate(); err != nil {
+			h.fail(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	for _, wr := range writes {
+		h.write(wr)
+	}
+	writeJSON(w, http.StatusAccepted, map[string]int{"accepted": len(writes)})
+}
+
+func (wr Write) validate() error {
+	if wr.Key == "" {
+		return errors.New("empty key")
+	}
+	switch wr.Op {
+	case "put":
+		_, err := wr.ttl()
+		return err
+	case "delete":
+		return nil
+	default:
+		return errors.New("unknown op " + wr.Op)
+	}
+}
+
+func (wr Write) ttl() (time.Duration, error) {
+	if wr.TTL == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(wr.TTL)
+	if err != nil {
+		return 0, err
+	}
+	if ttl <= 0 {
+		return 0, errors.New("ttl must be positive")
+	}
+	return ttl, nil
+}
+
+func (h *Handler) write(wr Write) error {
+	if err := wr.validate(); err != nil {
+		return err
+	}
+	p := h.proc(wr.Key)
+	if wr.Op == "delete" {
+		h.deletes.Add(1)
+		p.Delete(wr.Key)
+		return nil
+	}
+
+	h.puts.Add(1)
+	ttl, _ := wr.ttl()
+	if ttl > 0 {
+		p.AddWithTTL(wr.Key, wr.Data, ttl)
+		return nil
+	}
+	p.Add(wr.Key, wr.Data)
+	return nil
+}
+
+func (h *Handler) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		h.fail(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	writeJSON(w, http.StatusOK, h.Stats())
+}
+
+// Stats of the handler, the keys are counted only on an embedded entity
+func (h *Handler) Stats() Stats {
+	s := Stats{
+		Processes: len(h.procs),
+		Puts:      h.puts.Load(),
+		Deletes:   h.deletes.Load(),
+		Gets:      h.gets.Load(),
+		Errors:    h.errs.Load(),
+	}
+	if l, ok := h.ent.(interface{ Len() int }); ok {
+		n := l.Len()
+		s.Keys = &n
+	}
+	return s
+}
+
+func (h *Handler) fail(w http.ResponseWriter, code int, err error) {
+	h.errs.Add(1)
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
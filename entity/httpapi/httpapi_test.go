@@ -0,0 +1,154 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qwertyqq2/entity/entity"
+)
+
+const procLimit = 10
+
+func newServer(t *testing.T) (*httptest.Server, entity.Entity) {
+	ent := entity.New(procLimit)
+	h, err := New(ent, 1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(h)
+	t.Cleanup(func() {
+		srv.Close()
+		h.Close(context.Background())
+		ent.Shutdown()
+	})
+	return srv, ent
+}
+
+func do(t *testing.T, method, url, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// waitStatus repeats GET url until it answers with code
+func waitStatus(t *testing.T, url string, code int) *http.Response {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp := do(t, http.MethodGet, url, "")
+		if resp.StatusCode == code {
+			return resp
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("wrong status", resp.StatusCode, code)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestPutGetDelete(t *testing.T) {
+	srv, _ := newServer(t)
+
+	resp := do(t, http.MethodPut, srv.URL+"/keys/k1", "is k1")
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatal("wrong status", resp.StatusCode)
+	}
+
+	resp = waitStatus(t, srv.URL+"/keys/k1", http.StatusOK)
+	var v Value
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Key != "k1" || v.Data != "is k1" || v.Version != 1 || v.ExpiresAt != nil {
+		t.Fatal("wrong value", v)
+	}
+
+	resp = do(t, http.MethodDelete, srv.URL+"/keys/k1", "")
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatal("wrong status", resp.StatusCode)
+	}
+	waitStatus(t, srv.URL+"/keys/k1", http.StatusNotFound)
+}
+
+func TestPutTTL(t *testing.T) {
+	srv, _ := newServer(t)
+
+	if resp := do(t, http.MethodPut, srv.URL+"/keys/k1?ttl=1h", "is k1"); resp.StatusCode != http.StatusAccepted {
+		t.Fatal("wrong status", resp.StatusCode)
+	}
+	resp := waitStatus(t, srv.URL+"/keys/k1", http.StatusOK)
+	var v Value
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.ExpiresAt == nil {
+		t.Fatal("expected expiry", v)
+	}
+
+	if resp := do(t, http.MethodPut, srv.URL+"/keys/k2?ttl=soon", "is k2"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("wrong status", resp.StatusCode)
+	}
+}
+
+func TestBulk(t *testing.T) {
+	srv, ent := newServer(t)
+
+	body := `[
+		{"op": "put", "key": "k1", "data": "is k1"},
+		{"op": "put", "key": "k2", "data": "is k2"},
+		{"op": "put", "key": "k3", "data": "is k3"},
+		{"op": "delete", "key": "k3"}
+	]`
+	resp := do(t, http.MethodPost, srv.URL+"/keys", body)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatal("wrong status", resp.StatusCode)
+	}
+	var accepted map[string]int
+	if err := json.NewDecoder(resp.Body).Decode(&accepted); err != nil {
+		t.Fatal(err)
+	}
+	if accepted["accepted"] != 4 {
+		t.Fatal("wrong accepted", accepted)
+	}
+	waitStatus(t, srv.URL+"/keys/k2", http.StatusOK)
+	waitStatus(t, srv.URL+"/keys/k1", http.StatusOK)
+	waitStatus(t, srv.URL+"/keys/k3", http.StatusNotFound)
+
+	// one bad write rejects all of them
+	body = `[{"op": "put", "key": "k4"}, {"op": "move", "key": "k1"}]`
+	if resp := do(t, http.MethodPost, srv.URL+"/keys", body); resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("wrong status", resp.StatusCode)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if ent.Len() != 2 {
+		t.Fatal("wrong len", ent.Len())
+	}
+}
+
+func TestStats(t *testing.T) {
+	srv, _ := newServer(t)
+
+	do(t, http.MethodPut, srv.URL+"/keys/k1", "is k1")
+	waitStatus(t, srv.URL+"/keys/k1", http.StatusOK)
+	do(t, http.MethodPost, srv.URL+"/stats", "")
+
+	resp := do(t, http.MethodGet, srv.URL+"/stats", "")
+	var s Stats
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Processes != 4 || s.Keys == nil || *s.Keys != 1 || s.Puts != 1 || s.Gets == 0 || s.Errors == 0 {
+		t.Fatal("wrong stats", s)
+	}
+}
@@ -0,0 +1,108 @@
+package entity
+
+import (
+	"io"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+type Option func(*entity)
+
+// Storage engine for the data, the default is an unordered in-memory map
+func WithStore(store Store) Option {
+	return func(e *entity) {
+		e.store = store
+	}
+}
+
+// Fsync the log after every write. Enabled by default
+func SyncWrites(sync bool) Option {
+	return func(e *entity) {
+		e.syncWrites = sync
+	}
+}
+
+// Snapshot the data and truncate the log every interval.
+// Only used by entities opened with Open
+func SnapshotInterval(interval time.Duration) Option {
+	return func(e *entity) {
+		e.snapshotInterval = interval
+	}
+}
+
+// Clock used for key expiry, snapshots and the session timeouts
+func WithClock(c clock.Clock) Option {
+	return func(e *entity) {
+		e.clock = c
+	}
+}
+
+// Number of events a watcher may fall behind before it is dropped
+func WatchBuffer(n int) Option {
+	return func(e *entity) {
+		e.watchBuffer = n
+	}
+}
+
+// What Connect does when procLimit processes are connected
+type LimitPolicy int
+
+const (
+	// Connect fails with ErrProcLimit
+	RejectNew LimitPolicy = iota
+	// The session idle the longest is disconnected to make room
+	EvictIdle
+)
+
+// Policy for a Connect over the process limit, RejectNew by default
+func ProcLimitPolicy(p LimitPolicy) Option {
+	return func(e *entity) {
+		e.limitPolicy = p
+	}
+}
+
+// A session without messages for d is closed, 0 keeps it open.
+// 10s by default
+func IdleTimeout(d time.Duration) Option {
+	return func(e *entity) {
+		e.idleTimeout = d
+	}
+}
+
+// How long Resp waits for a response. 5s by default
+func ResponseTimeout(d time.Duration) Option {
+	return func(e *entity) {
+		e.respTimeout = d
+	}
+}
+
+// Capacity of the message and response channels of a session. 100 by default
+func SessionBuffer(n int) Option {
+	return func(e *entity) {
+		e.sessionBuffer = n
+	}
+}
+
+// How long the sequence of a write is kept to drop its resends, 0 keeps them forever.
+// 10m by default
+func DedupWindow(d time.Duration) Option {
+	return func(e *entity) {
+		e.seqs.window = d
+	}
+}
+
+// Logger for sessions, background errors and every handled message at debug level.
+// Silent by default
+func WithLogger(l *slog.Logger) Option {
+	return func(e *entity) {
+		e.logger = l
+	}
+}
+
+// discardLogger is enabled for no level, so the records are not even built
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.Level(math.MaxInt)}))
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/qwertyqq2/entity/entity"
+	mes "github.com/qwertyqq2/entity/message"
+)
+
+const helloTimeout = 5 * time.Second
+
+var ErrServerClosed = errors.New("server closed")
+
+// Server gives processes access to an entity over TCP.
+// A connection carries one process: Hello with the process id, then its messages,
+// the responses of the entity go back in the same order
+type Server struct {
+	ent    entity.Entity
+	logger *slog.Logger
+
+	lk        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[int]*conn
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+type conn struct {
+	net.Conn
+	proc int
+	// closed when the session of the process is gone
+	gone chan struct{}
+}
+
+type Option func(*Server)
+
+// Logger for connections that break the protocol. Silent by default
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = l
+	}
+}
+
+func New(ent entity.Entity, opts ...Option) *Server {
+	s := &Server{
+		ent:       ent,
+		logger:    slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.Level(math.MaxInt)})),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[int]*conn),
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until Close, then returns ErrServerClosed
+func (s *Server) Serve(l net.Listener) error {
+	s.lk.Lock()
+	if s.closed {
+		s.lk.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.lk.Unlock()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.lk.Lock()
+			closed := s.closed
+			delete(s.listeners, l)
+			s.lk.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(nc)
+		}()
+	}
+}
+
+// Close stops the listeners and drops all connections, the entity stays open
+func (s *Server) Close() error {
+	s.lk.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.lk.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) serveConn(nc net.Conn) {
+	defer nc.Close()
+
+	nc.SetReadDeadline(time.Now().Add(helloTimeout))
+	// nothing but a Hello is decoded before the process is connected
+	proc, err := mes.ReadHello(nc)
+	if err != nil {
+		return
+	}
+	nc.SetReadDeadline(time.Time{})
+
+	c, err := s.register(nc, proc)
+	if err != nil {
+		mes.WriteFrame(nc, mes.WelcomeFrame(err))
+		return
+	}
+	defer s.unregister(c)
+
+	ch, err := s.ent.Connect(c.proc)
+	if err != nil {
+		mes.WriteFrame(nc, mes.WelcomeFrame(err))
+		return
+	}
+	if err := mes.WriteFrame(nc, mes.WelcomeFrame(nil)); err != nil {
+		s.ent.Disconnect(c.proc)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := ctx.Done()
+	ended := s.ent.Done(c.proc)
+	written := make(chan struct{})
+	defer func() {
+		cancel()
+		s.ent.Disconnect(c.proc)
+		// a new connection of the process must not meet the old writer
+		<-written
+	}()
+	go func() {
+		defer close(written)
+		s.writeResponses(ctx, c)
+	}()
+	go func() {
+		select {
+		case <-ended:
+			// the entity ended the session, the process sees the connection break and dials again
+			nc.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		f, err := mes.ReadFrame(nc)
+		if err != nil {
+			return
+		}
+		if f.Kind != mes.FrameMessage {
+			s.logger.Warn("unexpected frame", "proc", c.proc, "kind", f.Kind)
+			return
+		}
+		select {
+		case ch <- f.Msg:
+		case <-ended:
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// writeResponses sends the responses of the entity to the process until ctx is done,
+// the wait for a response ends with ctx so the connection is closed at once
+func (s *Server) writeResponses(ctx context.Context, c *conn) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		resp := s.ent.RespContext(ctx, c.proc)
+		if resp.IsNil() {
+			continue
+		}
+		if err := mes.WriteFrame(c, mes.MessageFrame(resp)); err != nil {
+			c.Close()
+			return
+		}
+	}
+}
+
+// register takes the process id for the connection.
+// A process that dials again replaces its old connection,
+// the old session is closed before the new one is opened
+func (s *Server) register(nc net.Conn, proc int) (*conn, error) {
+	c := &conn{Conn: nc, proc: proc, gone: make(chan struct{})}
+	for {
+		s.lk.Lock()
+		if s.closed {
+			s.lk.Unlock()
+			return nil, ErrServerClosed
+		}
+		old, ok := s.conns[proc]
+		if !ok {
+			s.conns[proc] = c
+			s.lk.Unlock()
+			return c, nil
+		}
+		s.lk.Unlock()
+
+		old.Close()
+		<-old.gone
+	}
+}
+
+func (s *Server) unregister(c *conn) {
+	s.lk.Lock()
+	if s.conns[c.proc] == c {
+		delete(s.conns, c.proc)
+	}
+	s.lk.Unlock()
+	close(c.gone)
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/qwertyqq2/entity/entity"
+	mes "github.com/qwertyqq2/entity/message"
+	"github.com/qwertyqq2/entity/process"
+)
+
+const procLimit = 10
+
+func serve(t *testing.T, ent entity.Entity, addr string) (*Server, string) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := New(ent)
+	go srv.Serve(l)
+	return srv, l.Addr().String()
+}
+
+// waitLen waits until the entity has n keys
+func waitLen(t *testing.T, ent entity.Entity, n int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for ent.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatal("wrong len", ent.Len(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServe(t *testing.T) {
+	ent := entity.New(procLimit)
+	defer ent.Shutdown()
+	srv, addr := serve(t, ent, "127.0.0.1:0")
+	defer srv.Close()
+
+	proc, err := process.WithEntity(1, process.DialTCP(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Shutdown()
+
+	proc.Add("k1", "is k1")
+	proc.Add("k2", "is k2")
+	waitLen(t, ent, 2)
+
+	in, err := proc.Get("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Data != "is k1" {
+		t.Fatal("wrong value", in)
+	}
+	if ok, err := proc.Has("k3"); err != nil || ok {
+		t.Fatal("k3 must not exist", ok, err)
+	}
+	if _, err := proc.CompareAndSwap("k1", 2, "new k1"); err != process.ErrVersionMismatch {
+		t.Fatal("expected version mismatch", err)
+	}
+}
+
+func TestConnectTwice(t *testing.T) {
+	ent := entity.New(1)
+	defer ent.Shutdown()
+	srv, addr := serve(t, ent, "127.0.0.1:0")
+	defer srv.Close()
+
+	tr := process.DialTCP(addr)
+	if _, err := tr.Connect(1); err != nil {
+		t.Fatal(err)
+	}
+	// the same process takes the place of its old connection
+	if _, err := tr.Connect(1); err != nil {
+		t.Fatal(err)
+	}
+	// the limit of the entity is reported to the process
+	if _, err := process.DialTCP(addr).Connect(2); err == nil {
+		t.Fatal("expected limit error")
+	}
+	if err := tr.Disconnect(1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	ent := entity.New(procLimit)
+	defer ent.Shutdown()
+	srv, addr := serve(t, ent, "127.0.0.1:0")
+
+	proc, err := process.WithEntity(1, process.DialTCP(addr),
+		process.WaitRespInterval(200*time.Millisecond),
+		process.ReconnectInterval(50*time.Millisecond),
+		process.MaxWaitingConnection(time.Minute),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Shutdown()
+
+	proc.Add("k1", "is k1")
+	waitLen(t, ent, 1)
+
+	srv.Close()
+	srv, _ = serve(t, ent, addr)
+	defer srv.Close()
+
+	proc.Add("k2", "is k2")
+	waitLen(t, ent, 2)
+}
+
+func TestRedialAfterIdle(t *testing.T) {
+	ent := entity.New(procLimit, entity.IdleTimeout(50*time.Millisecond))
+	defer ent.Shutdown()
+	srv, addr := serve(t, ent, "127.0.0.1:0")
+	defer srv.Close()
+
+	tr := process.DialTCP(addr)
+	if _, err := tr.Connect(1); err != nil {
+		t.Fatal(err)
+	}
+	// the session is closed while the connection is still up
+	time.Sleep(200 * time.Millisecond)
+
+	// the old connection is torn down without waiting for the response timeout
+	now := time.Now()
+	if _, err := tr.Connect(1); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(now); d > time.Second {
+		t.Fatal("redial waited", d)
+	}
+	tr.Disconnect(1)
+}
+
+func TestCloseAfterIdle(t *testing.T) {
+	ent := entity.New(procLimit, entity.IdleTimeout(50*time.Millisecond))
+	defer ent.Shutdown()
+	srv, addr := serve(t, ent, "127.0.0.1:0")
+	defer srv.Close()
+
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	if err := mes.WriteFrame(nc, mes.HelloFrame(1)); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := mes.ReadFrame(nc); err != nil || f.Kind != mes.FrameWelcome {
+		t.Fatal("no welcome", f, err)
+	}
+	// the idle session is closed and the connection with it
+	nc.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := mes.ReadFrame(nc); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("connection is open", err)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	ent := entity.New(procLimit)
+	defer ent.Shutdown()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	srv := New(ent, WithLogger(slog.New(slog.NewJSONHandler(&out, nil))))
+	go srv.Serve(l)
+
+	nc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	if err := mes.WriteFrame(nc, mes.HelloFrame(1)); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := mes.ReadFrame(nc); err != nil || f.Kind != mes.FrameWelcome {
+		t.Fatal("no welcome", f, err)
+	}
+	// a second hello breaks the protocol and the server drops the connection
+	if err := mes.WriteFrame(nc, mes.HelloFrame(1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mes.ReadFrame(nc); err == nil {
+		t.Fatal("connection is open")
+	}
+	srv.Close()
+	if !strings.Contains(out.String(), `"msg":"unexpected frame","proc":1`) {
+		t.Fatal("no record", out.String())
+	}
+}
+
+// advance moves mock forward until done is closed
+func advance(t *testing.T, mock *clock.Mock, done <-chan struct{}) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("not done on the mock clock")
+		}
+		mock.Add(time.Second)
+	}
+}
+
+func TestTCPClock(t *testing.T) {
+	ent := entity.New(procLimit)
+	defer ent.Shutdown()
+	srv, addr := serve(t, ent, "127.0.0.1:0")
+	defer srv.Close()
+
+	mock := clock.NewMock()
+	tr := process.DialTCP(addr, process.TCPClock(mock))
+	if _, err := tr.Connect(1); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Disconnect(1)
+
+	// the response timeout is on the mock clock
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp := tr.Resp(1); !resp.IsNil() {
+			t.Error("response without message", resp)
+		}
+	}()
+	advance(t, mock, done)
+
+	// a missing connection is waited out, not answered at once
+	if err := tr.Disconnect(1); err != nil {
+		t.Fatal(err)
+	}
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		tr.Resp(1)
+	}()
+	select {
+	case <-done:
+		t.Fatal("no wait without a connection")
+	case <-time.After(50 * time.Millisecond):
+	}
+	advance(t, mock, done)
+
+	// and so is the handshake with a server that never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := process.DialTCP(l.Addr().String(), process.TCPClock(mock)).Connect(1); !errors.Is(err, process.ErrHandshakeTimeout) {
+			t.Error("expected handshake timeout", err)
+		}
+	}()
+	advance(t, mock, done)
+}
@@ -0,0 +1,264 @@
+package entity
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	snapshotFile    = "snapshot"
+	snapshotMagic   = "ENTS"
+	snapshotVersion = 5
+
+	// sanity limit for a key or data length read from a snapshot
+	maxSnapshotString = 1 << 30
+)
+
+var (
+	ErrBadSnapshot      = errors.New("bad snapshot")
+	ErrSnapshotVersion  = errors.New("unsupported snapshot version")
+	ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+	errSnapshotTooShort = errors.New("snapshot is too short")
+)
+
+// Snapshot format:
+// magic | uint16 version | uvarint count | count * entry [| uvarint version floor [| sequences]] | crc32
+// Entry of version 1: uvarint len(key) | key | uvarint len(data) | data
+// Entry of version 2: version 1 entry | varint expires at, unix nano or 0
+// Entry of version 3: version 2 entry | uvarint key version
+// The version floor is written since version 4.
+// Sequences since version 5: uvarint count | count * (varint proc | uvarint len(key) | key | uvarint seq), the oldest first.
+// The checksum covers everything before it
+func writeSnapshot(w io.Writer, store Store, floor uint64, marks []seqMark) error {
+	var (
+		bw  = bufio.NewWriter(w)
+		crc = crc32.New(crcTable)
+		mw  = io.MultiWriter(bw, crc)
+		buf = make([]byte, 0, 64)
+	)
+
+	buf = append(buf, snapshotMagic...)
+	buf = binary.LittleEndian.AppendUint16(buf, snapshotVersion)
+	buf = binary.AppendUvarint(buf, uint64(store.Len()))
+	if _, err := mw.Write(buf); err != nil {
+		return err
+	}
+
+	var werr error
+	err := store.Iterate(func(in Inside) bool {
+		buf = appendString(buf[:0], in.Key)
+		buf = appendString(buf, in.Data)
+		buf = binary.AppendVarint(buf, unixNano(in.ExpiresAt))
+		buf = binary.AppendUvarint(buf, in.Version)
+		_, werr = mw.Write(buf)
+		return werr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if werr != nil {
+		return werr
+	}
+	buf = binary.AppendUvarint(buf[:0], floor)
+	buf = binary.AppendUvarint(buf, uint64(len(marks)))
+	if _, err := mw.Write(buf); err != nil {
+		return err
+	}
+	for _, sm := range marks {
+		buf = binary.AppendVarint(buf[:0], int64(sm.proc))
+		buf = appendString(buf, sm.key)
+		buf = binary.AppendUvarint(buf, sm.seq)
+		if _, err := mw.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	if _, err := bw.Write(binary.LittleEndian.AppendUint32(buf[:0], crc.Sum32())); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// readSnapshot calls fn for every value and mark, if it is not nil, for every sequence.
+// Returns the version floor
+func readSnapshot(r io.Reader, fn func(in Inside) error, mark func(sm seqMark)) (uint64, error) {
+	br := &hashReader{
+		r:   bufio.NewReader(r),
+		crc: crc32.New(crcTable),
+	}
+
+	header := make([]byte, len(snapshotMagic)+2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return 0, errSnapshotTooShort
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, ErrBadSnapshot
+	}
+	version := binary.LittleEndian.Uint16(header[len(snapshotMagic):])
+	if version < 1 || version > snapshotVersion {
+		return 0, ErrSnapshotVersion
+	}
+
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return 0, errSnapshotTooShort
+	}
+	for i := uint64(0); i < count; i++ {
+		key, err := readSnapshotString(br)
+		if err != nil {
+			return 0, err
+		}
+		data, err := readSnapshotString(br)
+		if err != nil {
+			return 0, err
+		}
+		in := Inside{Key: key, Data: data}
+		if version >= 2 {
+			expires, err := binary.ReadVarint(br)
+			if err != nil {
+				return 0, errSnapshotTooShort
+			}
+			in.ExpiresAt = fromUnixNano(expires)
+		}
+		if version >= 3 {
+			if in.Version, err = binary.ReadUvarint(br); err != nil {
+				return 0, errSnapshotTooShort
+			}
+		}
+		if err := fn(in); err != nil {
+			return 0, err
+		}
+	}
+	var floor uint64
+	if version >= 4 {
+		if floor, err = binary.ReadUvarint(br); err != nil {
+			return 0, errSnapshotTooShort
+		}
+	}
+	if version >= 5 {
+		if err := readSnapshotSeqs(br, mark); err != nil {
+			return 0, err
+		}
+	}
+
+	sum := br.crc.Sum32()
+	var trailer [4]byte
+	if _, err := io.ReadFull(br.r, trailer[:]); err != nil {
+		return 0, errSnapshotTooShort
+	}
+	if binary.LittleEndian.Uint32(trailer[:]) != sum {
+		return 0, ErrSnapshotChecksum
+	}
+	return floor, nil
+}
+
+// ReadSnapshot calls fn for every value of a snapshot written by Entity.Snapshot
+func ReadSnapshot(r io.Reader, fn func(in Inside) error) error {
+	_, err := readSnapshot(r, fn, nil)
+	return err
+}
+
+func readSnapshotSeqs(r *hashReader, mark func(sm seqMark)) error {
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return errSnapshotTooShort
+	}
+	for i := uint64(0); i < count; i++ {
+		proc, err := binary.ReadVarint(r)
+		if err != nil {
+			return errSnapshotTooShort
+		}
+		key, err := readSnapshotString(r)
+		if err != nil {
+			return err
+		}
+		seq, err := binary.ReadUvarint(r)
+		if err != nil {
+			return errSnapshotTooShort
+		}
+		if mark != nil {
+			mark(seqMark{proc: int(proc), key: key, seq: seq})
+		}
+	}
+	return nil
+}
+
+// hashReader sums up the bytes consumed from r
+type hashReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+func (h *hashReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.crc.Write(p[:n])
+	return n, err
+}
+
+func (h *hashReader) ReadByte() (byte, error) {
+	b, err := h.r.ReadByte()
+	if err == nil {
+		h.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+func readSnapshotString(r *hashReader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", errSnapshotTooShort
+	}
+	if n > maxSnapshotString {
+		return "", ErrBadSnapshot
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", errSnapshotTooShort
+	}
+	return string(buf), nil
+}
+
+// loadSnapshot calls put for every value of the snapshot in dir if there is one,
+// passes its sequences to mark and returns its version floor
+func loadSnapshot(dir string, put func(in Inside) error, mark func(sm seqMark)) (uint64, error) {
+	f, err := os.Open(filepath.Join(dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return readSnapshot(f, put, mark)
+}
+
+// saveSnapshot atomically replaces the snapshot in dir
+func saveSnapshot(dir string, store Store, floor uint64, marks []seqMark) error {
+	tmp := filepath.Join(dir, snapshotFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := writeSnapshot(f, store, floor, marks); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, snapshotFile)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
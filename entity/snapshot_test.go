@@ -0,0 +1,219 @@
+package entity
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	mes "github.com/qwertyqq2/entity/message"
+)
+
+func fill(t *testing.T, e *entity, n int) {
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err := e.add(0, 0, mes.NewInside(key, "data for "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	e := newEntity(procLimit)
+	fill(t, e, 100)
+
+	var buf bytes.Buffer
+	if err := e.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := Restore(&buf, procLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Len() != 100 {
+		t.Fatal("wrong len", restored.Len())
+	}
+	if in, _ := restored.(*entity).get("key42"); in.Data != "data for key42" || in.Version != 1 {
+		t.Fatal("wrong data", in.Data)
+	}
+}
+
+func TestRestoreCorrupt(t *testing.T) {
+	e := newEntity(procLimit)
+	fill(t, e, 10)
+
+	var buf bytes.Buffer
+	if err := e.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snap := buf.Bytes()
+
+	flipped := append([]byte(nil), snap...)
+	flipped[len(flipped)/2] ^= 0xff
+	if _, err := Restore(bytes.NewReader(flipped), procLimit); err == nil {
+		t.Fatal("corrupt snapshot restored")
+	}
+
+	version := append([]byte(nil), snap...)
+	version[len(snapshotMagic)] = 0xff
+	if _, err := Restore(bytes.NewReader(version), procLimit); err != ErrSnapshotVersion {
+		t.Fatal("expected version error", err)
+	}
+
+	if _, err := Restore(bytes.NewReader(snap[:len(snap)-2]), procLimit); err == nil {
+		t.Fatal("short snapshot restored")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+
+	ent, err := Open(dir, procLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := ent.(*entity)
+	fill(t, e, 50)
+	if err := e.delete(0, 0, "key0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ent.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(filepath.Join(dir, walFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size() != 0 {
+		t.Fatal("log is not truncated", st.Size())
+	}
+
+	// writes after the snapshot go to the log
+	if err := e.add(0, 0, mes.NewInside("after", "compact")); err != nil {
+		t.Fatal(err)
+	}
+	ent.Shutdown()
+
+	ent, err = Open(dir, procLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ent.Shutdown()
+
+	if ent.Len() != 50 {
+		t.Fatal("wrong len", ent.Len())
+	}
+	e = ent.(*entity)
+	if ok, _ := e.has("key0"); ok {
+		t.Fatal("deleted key restored")
+	}
+	if in, _ := e.get("after"); in.Data != "compact" {
+		t.Fatal("lost write after compact")
+	}
+}
+
+// version of key, 0 if there is none
+func versionOf(t *testing.T, e *entity, key string) uint64 {
+	in, err := e.get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return in.Version
+}
+
+func TestVersionFloor(t *testing.T) {
+	dir := t.TempDir()
+	mock := clock.NewMock()
+	ent, err := Open(dir, procLimit, WithClock(mock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := ent.(*entity)
+
+	// k1 at version 3 is deleted and written again
+	for i := 0; i < 3; i++ {
+		if err := e.add(0, 0, mes.NewInside("k1", "is k1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.delete(0, 0, "k1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.cas(0, mes.NewInside("k1", "is k1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if v := versionOf(t, e, "k1"); v != 4 {
+		t.Fatal("version went back", v)
+	}
+	if _, err := e.cas(0, mes.NewInside("k1", "stale"), 1); err != ErrVersionMismatch {
+		t.Fatal("cas with the old version", err)
+	}
+
+	// a new key starts above the floor, k2 at version 8 expires
+	for i := 0; i < 4; i++ {
+		if err := e.add(0, 0, mes.NewInside("k2", "is k2")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	in := mes.NewInside("k2", "is k2")
+	in.ExpiresAt = mock.Now().Add(time.Second)
+	if err := e.add(0, 0, in); err != nil {
+		t.Fatal(err)
+	}
+	mock.Add(2 * time.Second)
+	if err := e.add(0, 0, mes.NewInside("k2", "is k2")); err != nil {
+		t.Fatal(err)
+	}
+	if v := versionOf(t, e, "k2"); v != 9 {
+		t.Fatal("version went back after expiry", v)
+	}
+	if err := e.delete(0, 0, "k2"); err != nil {
+		t.Fatal(err)
+	}
+	ent.Shutdown()
+
+	// the floor is replayed from the log
+	ent, err = Open(dir, procLimit, WithClock(mock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = ent.(*entity)
+	if e.floor != 9 {
+		t.Fatal("wrong floor after replay", e.floor)
+	}
+
+	// and read from the snapshot once the log is gone
+	if err := ent.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	ent.Shutdown()
+	ent, err = Open(dir, procLimit, WithClock(mock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ent.Shutdown()
+	e = ent.(*entity)
+	if err := e.add(0, 0, mes.NewInside("k2", "is k2")); err != nil {
+		t.Fatal(err)
+	}
+	if v := versionOf(t, e, "k2"); v != 10 {
+		t.Fatal("version went back after compact", v)
+	}
+
+	var buf bytes.Buffer
+	if err := ent.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := Restore(&buf, procLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := restored.(*entity).floor; f != 9 {
+		t.Fatal("wrong floor after restore", f)
+	}
+}
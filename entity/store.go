@@ -0,0 +1,75 @@
+package entity
+
+// Storage engine of an entity.
+// Calls are serialized by the entity, so implementations don't need to be safe for concurrent use
+type Store interface {
+	// Returns ErrNotFound if there is no such key
+	Get(key string) (Inside, error)
+
+	// Inserts or replaces the value by in.Key
+	Put(in Inside) error
+
+	// Deleting a missing key is not an error
+	Delete(key string) error
+
+	// Calls fn for every value until fn returns false.
+	// The store must not be changed from fn
+	Iterate(fn func(in Inside) bool) error
+
+	// Number of stored keys
+	Len() int
+}
+
+// Store that keeps its values across restarts, like FileStore.
+// Open does not load the snapshot into it and puts only the log records it misses
+type DurableStore interface {
+	Store
+	Durable() bool
+}
+
+// isDurable reports whether the store keeps its values itself
+func isDurable(s Store) bool {
+	d, ok := s.(DurableStore)
+	return ok && d.Durable()
+}
+
+// Unordered in-memory store, the default one
+type mapStore struct {
+	vals map[string]Inside
+}
+
+func NewMapStore() Store {
+	return &mapStore{
+		vals: make(map[string]Inside),
+	}
+}
+
+func (s *mapStore) Get(key string) (Inside, error) {
+	if in, ok := s.vals[key]; ok {
+		return in, nil
+	}
+	return Inside{}, ErrNotFound
+}
+
+func (s *mapStore) Put(in Inside) error {
+	s.vals[in.Key] = in
+	return nil
+}
+
+func (s *mapStore) Delete(key string) error {
+	delete(s.vals, key)
+	return nil
+}
+
+func (s *mapStore) Iterate(fn func(in Inside) bool) error {
+	for _, in := range s.vals {
+		if !fn(in) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *mapStore) Len() int {
+	return len(s.vals)
+}
@@ -0,0 +1,234 @@
+package entity
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	mes "github.com/qwertyqq2/entity/message"
+)
+
+// checkStore applies random puts and deletes to the store and to a map and compares them
+func checkStore(t *testing.T, store Store) {
+	var (
+		rnd  = rand.New(rand.NewSource(1))
+		want = make(map[string]Inside)
+	)
+
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key%d", rnd.Intn(500))
+		if rnd.Intn(3) == 0 {
+			if err := store.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+			delete(want, key)
+			continue
+		}
+		in := mes.NewInside(key, fmt.Sprintf("data %d", i))
+		if err := store.Put(in); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = in
+	}
+
+	if store.Len() != len(want) {
+		t.Fatal("wrong len", store.Len(), len(want))
+	}
+	for key, in := range want {
+		got, err := store.Get(key)
+		if err != nil {
+			t.Fatal(key, err)
+		}
+		if got != in {
+			t.Fatal("wrong value", got, in)
+		}
+	}
+	if _, err := store.Get("missing"); err != ErrNotFound {
+		t.Fatal("expected not found", err)
+	}
+
+	n := 0
+	err := store.Iterate(func(in Inside) bool {
+		if want[in.Key] != in {
+			t.Fatal("iterate wrong value", in)
+		}
+		n++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(want) {
+		t.Fatal("iterate wrong count", n)
+	}
+}
+
+func TestMapStore(t *testing.T) {
+	checkStore(t, NewMapStore())
+}
+
+func TestBTreeStore(t *testing.T) {
+	checkStore(t, NewBTreeStore(2))
+	checkStore(t, NewBTreeStore(0))
+}
+
+func TestBTreeStoreOrder(t *testing.T) {
+	store := NewBTreeStore(3)
+	keys := rand.New(rand.NewSource(2)).Perm(1000)
+	for _, k := range keys {
+		if err := store.Put(mes.NewInside(fmt.Sprintf("%04d", k), "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for k := 0; k < 1000; k += 2 {
+		if err := store.Delete(fmt.Sprintf("%04d", k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := make([]string, 0, store.Len())
+	store.Iterate(func(in Inside) bool {
+		got = append(got, in.Key)
+		return true
+	})
+	if len(got) != 500 || !sort.StringsAreSorted(got) {
+		t.Fatal("keys are not ordered", len(got))
+	}
+
+	n := 0
+	store.Iterate(func(in Inside) bool {
+		n++
+		return n < 10
+	})
+	if n != 10 {
+		t.Fatal("iterate did not stop", n)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store")
+
+	store, err := OpenFileStore(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStore(t, store)
+	n := store.Len()
+	var in Inside
+	store.Iterate(func(first Inside) bool {
+		in = first
+		return false
+	})
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenFileStore(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.Len() != n {
+		t.Fatal("wrong len after reopen", store.Len(), n)
+	}
+	if got, err := store.Get(in.Key); err != nil || got != in {
+		t.Fatal("wrong value after reopen", got, err)
+	}
+}
+
+func TestEntityWithStore(t *testing.T) {
+	ent := New(procLimit, WithStore(NewBTreeStore(0)))
+	defer ent.Shutdown()
+
+	p := newProc(1)
+	if err := p.Connect(ent); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []Message{
+		mes.AddMessage("b", "is b"),
+		mes.AddMessage("a", "is a"),
+	} {
+		if err := p.Send(m, ent); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ent.String() != "key: a, data: is a \nkey: b, data: is b \n" {
+		t.Fatal("wrong order", ent.String())
+	}
+}
+
+func TestOpenFileStore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "store")
+
+	open := func() *entity {
+		store, err := OpenFileStore(path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ent, err := Open(dir, procLimit, WithStore(store))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ent.(*entity)
+	}
+	size := func() int64 {
+		st, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st.Size()
+	}
+
+	e := open()
+	for _, key := range []string{"n1", "n2", "n3"} {
+		if err := e.add(0, 0, mes.NewInside(key, "is "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.delete(0, 0, "n2"); err != nil {
+		t.Fatal(err)
+	}
+	e.Shutdown()
+	n := size()
+
+	// the store has every logged record, nothing is written again
+	e = open()
+	if e.Len() != 2 || size() != n {
+		t.Fatal("records are written again", e.Len(), size(), n)
+	}
+	if err := e.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	e.Shutdown()
+	e = open()
+	if e.Len() != 2 || size() != n {
+		t.Fatal("snapshot is written again", e.Len(), size(), n)
+	}
+	e.Shutdown()
+
+	// a write logged but lost by the store before a crash
+	w, err := openWal(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := mes.NewInside("n4", "is n4")
+	in.Version = 4
+	if err := w.append(walOp{op: mes.Add, in: in}); err != nil {
+		t.Fatal(err)
+	}
+	w.close()
+
+	e = open()
+	defer e.Shutdown()
+	if got, err := e.get("n4"); err != nil || got.Version != 4 {
+		t.Fatal("logged write is lost", got, err)
+	}
+	if e.Len() != 3 {
+		t.Fatal("wrong len", e.Len())
+	}
+}
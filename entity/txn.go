@@ -0,0 +1,117 @@
+package entity
+
+import (
+	mes "github.com/qwertyqq2/entity/message"
+)
+
+func (e *entity) handleTxn(id int, m Message) Message {
+	results, err := e.txn(id, m.Ops)
+	if err != nil {
+		return mes.FailMessage(err)
+	}
+	resp := mes.SuccessMessage()
+	resp.Ops = results
+	return resp
+}
+
+// txn applies all ops of the process proc under one lock acquisition or none of them.
+// Ops see the writes of the ops before them, the result of every op is returned
+func (e *entity) txn(proc int, ops []Message) ([]Message, error) {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+
+	var (
+		// keys written by the txn, a zero value is a deleted key
+		view    = make(map[string]Inside)
+		writes  = make([]walOp, 0, len(ops))
+		events  = make([]Event, 0, len(ops))
+		results = make([]Message, 0, len(ops))
+		// floor with the keys deleted by the txn
+		floor = e.floor
+	)
+
+	current := func(key string) (Inside, error) {
+		if in, ok := view[key]; ok {
+			return in, nil
+		}
+		return e.current(key)
+	}
+
+	for _, m := range ops {
+		key := m.Inside.Key
+		old, err := current(key)
+		if err != nil {
+			return nil, err
+		}
+
+		switch m.Op {
+		case mes.Add, mes.CAS:
+			if m.Op == mes.CAS && old.Version != m.Inside.Version {
+				return nil, ErrVersionMismatch
+			}
+			in := e.toStore(m)
+			in.Version = e.nextVersion(key, old, floor)
+			view[key] = in
+			writes = append(writes, walOp{op: mes.Add, in: in})
+			events = append(events, Event{Key: key, Op: m.Op, Old: old, New: in, Version: in.Version, Proc: proc})
+			results = append(results, mes.ValueMessage(in))
+
+		case mes.Delete:
+			view[key] = Inside{}
+			if old.Version > floor {
+				floor = old.Version
+			}
+			del := mes.NewInside(key, "")
+			del.Version = old.Version
+			writes = append(writes, walOp{op: mes.Delete, in: del})
+			if old.Key != "" {
+				events = append(events, Event{Key: key, Op: m.Op, Old: old, Version: old.Version, Proc: proc})
+			}
+			results = append(results, mes.SuccessMessage())
+
+		default:
+			return nil, ErrTxnOp
+		}
+	}
+	if len(writes) == 0 {
+		return results, nil
+	}
+
+	// the stored values to go back to if the store fails in the middle.
+	// The txn is in the log by then, an abort record keeps it from being applied on replay
+	undo := make([]walOp, 0, len(view))
+	for key := range view {
+		in, err := e.store.Get(key)
+		switch err {
+		case nil:
+			undo = append(undo, walOp{op: mes.Add, in: in})
+		case ErrNotFound:
+			undo = append(undo, walOp{op: mes.Delete, in: mes.NewInside(key, "")})
+		default:
+			return nil, err
+		}
+	}
+
+	if e.wal != nil {
+		if err := e.wal.appendTxn(writes); err != nil {
+			return nil, err
+		}
+	}
+	for _, w := range writes {
+		if err := e.apply(w); err != nil {
+			for _, u := range undo {
+				e.apply(u)
+			}
+			if e.wal != nil {
+				if err := e.wal.appendAbort(); err != nil {
+					e.logger.Error("abort txn", "err", err)
+				}
+			}
+			return nil, err
+		}
+	}
+	for _, ev := range events {
+		e.notify(ev)
+	}
+	return results, nil
+}
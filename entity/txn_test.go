@@ -0,0 +1,184 @@
+package entity
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	mes "github.com/qwertyqq2/entity/message"
+)
+
+func TestSendTxn(t *testing.T) {
+	constructor()
+
+	if err := proc1.Connect(ent); err != nil {
+		t.Fatal(err)
+	}
+	if err := proc1.Send(mes.AddMessage("n1", "is n1"), ent); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := proc1.Request(mes.TxnMessage(
+		mes.AddMessage("n2", "is n2"),
+		// sees the write before it
+		mes.CASMessage("n2", "is n2 again", 1),
+		mes.DeleteMessage("n1"),
+	), ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.IsSuccess() || len(resp.Ops) != 3 {
+		t.Fatal("txn failed", resp)
+	}
+	if resp.Ops[1].Inside.Version != 2 {
+		t.Fatal("wrong version", resp.Ops[1].Inside)
+	}
+	if ent.Len() != 1 {
+		t.Fatal("wrong len", ent.Len())
+	}
+}
+
+func TestTxnAllOrNothing(t *testing.T) {
+	e := newEntity(procLimit)
+	defer e.Shutdown()
+	if err := e.add(0, 0, mes.NewInside("n1", "is n1")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := e.txn(0, []Message{
+		mes.AddMessage("n2", "is n2"),
+		mes.DeleteMessage("n1"),
+		mes.CASMessage("n1", "stale", 1),
+	})
+	if err != ErrVersionMismatch {
+		t.Fatal("expected version mismatch", err)
+	}
+	if ok, _ := e.has("n2"); ok {
+		t.Fatal("n2 is applied")
+	}
+	if ok, _ := e.has("n1"); !ok {
+		t.Fatal("n1 is deleted")
+	}
+
+	if _, err := e.txn(0, []Message{mes.GetMessage("n1")}); err != ErrTxnOp {
+		t.Fatal("expected txn op error", err)
+	}
+}
+
+func TestTxnReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	ent, err := Open(dir, procLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := ent.(*entity)
+	if _, err := e.txn(0, []Message{
+		mes.AddMessage("n1", "is n1"),
+		mes.AddMessage("n2", "is n2"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, walFile)
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.txn(0, []Message{
+		mes.AddMessage("n3", "is n3"),
+		mes.DeleteMessage("n1"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ent.Shutdown()
+
+	// a torn txn record is dropped as a whole
+	if err := os.Truncate(path, st.Size()+walHeaderSize+2); err != nil {
+		t.Fatal(err)
+	}
+
+	ent, err = Open(dir, procLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ent.Shutdown()
+	e = ent.(*entity)
+	if ent.Len() != 2 {
+		t.Fatal("wrong len", ent.Len())
+	}
+	if ok, _ := e.has("n1"); !ok {
+		t.Fatal("half of the txn is applied")
+	}
+}
+
+// file store that fails to put the key bad
+type failStore struct {
+	*FileStore
+}
+
+func (s failStore) Put(in Inside) error {
+	if in.Key == "bad" {
+		return errors.New("put failed")
+	}
+	return s.FileStore.Put(in)
+}
+
+func TestTxnFailedStore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "store")
+
+	open := func(fail bool) *entity {
+		fs, err := OpenFileStore(path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var store Store = fs
+		if fail {
+			store = failStore{fs}
+		}
+		ent, err := Open(dir, procLimit, WithStore(store))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ent.(*entity)
+	}
+
+	e := open(true)
+	if err := e.add(0, 0, mes.NewInside("n1", "is n1")); err != nil {
+		t.Fatal(err)
+	}
+	// the txn is logged and fails in the middle of the store
+	if _, err := e.txn(0, []Message{
+		mes.AddMessage("n1", "new n1"),
+		mes.AddMessage("n2", "is n2"),
+		mes.AddMessage("bad", "is bad"),
+	}); err == nil {
+		t.Fatal("txn with a failed put is applied")
+	}
+	check := func(e *entity) {
+		if in, err := e.get("n1"); err != nil || in.Data != "is n1" {
+			t.Fatal("n1 is not rolled back", in, err)
+		}
+		if ok, _ := e.has("n2"); ok {
+			t.Fatal("n2 is not rolled back")
+		}
+	}
+	check(e)
+
+	// a closed log fails the txn before the store is written
+	e.wal.close()
+	if _, err := e.txn(0, []Message{mes.AddMessage("n2", "is n2")}); err != ErrClosed {
+		t.Fatal("expected closed log", err)
+	}
+	check(e)
+	e.Shutdown()
+
+	// replay skips the aborted txn
+	e = open(false)
+	defer e.Shutdown()
+	check(e)
+	if e.Len() != 1 {
+		t.Fatal("wrong len", e.Len())
+	}
+}
@@ -0,0 +1,408 @@
+package entity
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	mes "github.com/qwertyqq2/entity/message"
+)
+
+const (
+	walFile = "wal.log"
+
+	// crc32 + payload length
+	walHeaderSize = 8
+
+	// payload of a record that drops the txn record right before it
+	walAbort = 0xff
+)
+
+var (
+	ErrClosed     = errors.New("entity is closed")
+	ErrCorruptLog = errors.New("corrupt log record")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Write-ahead log of the changes applied to an entity.
+// Record: crc32(payload) | len(payload) | payload
+// Payload: op | uvarint len(key) | key | uvarint len(data) | data
+// [| varint expires at, unix nano or 0 [| uvarint version [| varint proc | uvarint seq]]]
+// or a txn of such payloads, see appendTxnRecord, or walAbort.
+// The proc and seq of a deduplicated write are logged with it, see seqs
+type wal struct {
+	f    *os.File
+	sync bool
+	buf  []byte
+}
+
+func openWal(dir string, sync bool) (*wal, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, walFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syncDir(dir); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &wal{
+		f:    f,
+		sync: sync,
+	}, nil
+}
+
+// replay calls fn for every record in the log, a txn with an abort after it is skipped.
+// A torn tail left by a crash is cut off, a bad record before the tail is ErrCorruptLog
+func (w *wal) replay(fn func(o walOp) error) error {
+	st, err := w.f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var (
+		r      = bufio.NewReader(w.f)
+		offset int64
+		// ops of the record before, held back until it is known that they are not aborted
+		held []walOp
+	)
+	flush := func() error {
+		for _, o := range held {
+			if err := fn(o); err != nil {
+				return err
+			}
+		}
+		held = nil
+		return nil
+	}
+	for {
+		payload, n, err := readRecord(r, st.Size()-offset)
+		if err == io.EOF {
+			break
+		}
+		if tornTail(err, offset, n, st.Size()) {
+			if err := w.f.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		if err == ErrCorruptLog {
+			return fmt.Errorf("%w at offset %d", err, offset)
+		}
+		if err != nil {
+			return err
+		}
+		offset += n
+		if len(payload) == 1 && payload[0] == walAbort {
+			held = nil
+			continue
+		}
+		ops, err := decodeRecord(payload)
+		if err != nil {
+			return err
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		held = ops
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	_, err = w.f.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (w *wal) append(o walOp) error {
+	if w.f == nil {
+		return ErrClosed
+	}
+
+	w.buf = appendRecord(w.buf[:0], o)
+	return w.write()
+}
+
+func (w *wal) appendTxn(ops []walOp) error {
+	if w.f == nil {
+		return ErrClosed
+	}
+
+	w.buf = appendTxnRecord(w.buf[:0], ops)
+	return w.write()
+}
+
+// appendAbort drops the txn appended last, its writes failed
+func (w *wal) appendAbort() error {
+	if w.f == nil {
+		return ErrClosed
+	}
+
+	w.buf = appendAbortRecord(w.buf[:0])
+	return w.write()
+}
+
+func (w *wal) write() error {
+	if _, err := w.f.Write(w.buf); err != nil {
+		return err
+	}
+	if w.sync {
+		return w.f.Sync()
+	}
+	return nil
+}
+
+// reset drops all records once they are saved in a snapshot
+func (w *wal) reset() error {
+	if w.f == nil {
+		return ErrClosed
+	}
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+func (w *wal) close() error {
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+type walOp struct {
+	op mes.Op
+	in Inside
+	// the process and the sequence of the write, 0 if it is not deduplicated
+	proc int
+	seq  uint64
+}
+
+func appendRecord(buf []byte, o walOp) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, walHeaderSize)...)
+	buf = appendOp(buf, o)
+	return sealRecord(buf, start)
+}
+
+// appendTxnRecord writes all ops as one record, so they are replayed all or none.
+// Payload: Txn | uvarint count | count * (uvarint len(op payload) | op payload)
+func appendTxnRecord(buf []byte, ops []walOp) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, walHeaderSize)...)
+	buf = append(buf, byte(mes.Txn))
+	buf = binary.AppendUvarint(buf, uint64(len(ops)))
+	for _, o := range ops {
+		op := appendOp(nil, o)
+		buf = binary.AppendUvarint(buf, uint64(len(op)))
+		buf = append(buf, op...)
+	}
+	return sealRecord(buf, start)
+}
+
+func appendAbortRecord(buf []byte) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, walHeaderSize)...)
+	buf = append(buf, walAbort)
+	return sealRecord(buf, start)
+}
+
+// sealRecord fills the header of the record that starts at start
+func sealRecord(buf []byte, start int) []byte {
+	payload := buf[start+walHeaderSize:]
+	binary.LittleEndian.PutUint32(buf[start:], crc32.Checksum(payload, crcTable))
+	binary.LittleEndian.PutUint32(buf[start+4:], uint32(len(payload)))
+	return buf
+}
+
+func appendOp(buf []byte, o walOp) []byte {
+	in := o.in
+	buf = append(buf, byte(o.op))
+	buf = appendString(buf, in.Key)
+	buf = appendString(buf, in.Data)
+	if !in.ExpiresAt.IsZero() || in.Version != 0 || o.seq != 0 {
+		buf = binary.AppendVarint(buf, unixNano(in.ExpiresAt))
+	}
+	if in.Version != 0 || o.seq != 0 {
+		buf = binary.AppendUvarint(buf, in.Version)
+	}
+	if o.seq != 0 {
+		buf = binary.AppendVarint(buf, int64(o.proc))
+		buf = binary.AppendUvarint(buf, o.seq)
+	}
+	return buf
+}
+
+// readRecord returns the checked payload of the record and the number of bytes it takes in the log.
+// left is the number of bytes from the record to the end of the log, nothing bigger is allocated:
+// a record that runs past the end is torn, io.ErrUnexpectedEOF,
+// a whole record with a bad checksum is ErrCorruptLog with its size
+func readRecord(r io.Reader, left int64) ([]byte, int64, error) {
+	if left <= 0 {
+		return nil, 0, io.EOF
+	}
+	if left < walHeaderSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	var header [walHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	sum := binary.LittleEndian.Uint32(header[0:])
+	size := binary.LittleEndian.Uint32(header[4:])
+	n := walHeaderSize + int64(size)
+	if n > left {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	if crc32.Checksum(payload, crcTable) != sum || len(payload) == 0 {
+		return nil, n, ErrCorruptLog
+	}
+	return payload, n, nil
+}
+
+// tornTail reports whether the error of readRecord is left by a crash in the middle of the last record.
+// A bad record with more after it is damage of the log
+func tornTail(err error, offset, n, size int64) bool {
+	return err == io.ErrUnexpectedEOF || err == ErrCorruptLog && offset+n == size
+}
+
+// decodeRecord returns the ops of a single or a txn record
+func decodeRecord(payload []byte) ([]walOp, error) {
+	if mes.Op(payload[0]) != mes.Txn {
+		o, err := decodeOp(payload)
+		if err != nil {
+			return nil, err
+		}
+		return []walOp{o}, nil
+	}
+
+	count, l := binary.Uvarint(payload[1:])
+	if l <= 0 || count > uint64(len(payload)) {
+		return nil, ErrCorruptLog
+	}
+	rest := payload[1+l:]
+	ops := make([]walOp, 0, count)
+	for i := uint64(0); i < count; i++ {
+		size, l := binary.Uvarint(rest)
+		if l <= 0 || size == 0 || uint64(len(rest)-l) < size {
+			return nil, ErrCorruptLog
+		}
+		o, err := decodeOp(rest[l : l+int(size)])
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, o)
+		rest = rest[l+int(size):]
+	}
+	return ops, nil
+}
+
+func decodeOp(payload []byte) (walOp, error) {
+	o := walOp{op: mes.Op(payload[0])}
+	key, rest, err := readString(payload[1:])
+	if err != nil {
+		return walOp{}, err
+	}
+	data, rest, err := readString(rest)
+	if err != nil {
+		return walOp{}, err
+	}
+	o.in = mes.NewInside(key, data)
+	if len(rest) > 0 {
+		expires, l := binary.Varint(rest)
+		if l <= 0 {
+			return walOp{}, ErrCorruptLog
+		}
+		o.in.ExpiresAt = fromUnixNano(expires)
+		rest = rest[l:]
+	}
+	if len(rest) > 0 {
+		version, l := binary.Uvarint(rest)
+		if l <= 0 {
+			return walOp{}, ErrCorruptLog
+		}
+		o.in.Version = version
+		rest = rest[l:]
+	}
+	if len(rest) > 0 {
+		proc, l := binary.Varint(rest)
+		if l <= 0 {
+			return walOp{}, ErrCorruptLog
+		}
+		seq, n := binary.Uvarint(rest[l:])
+		if n <= 0 {
+			return walOp{}, ErrCorruptLog
+		}
+		o.proc, o.seq = int(proc), seq
+	}
+	return o, nil
+}
+
+// zero time is written as 0
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func readString(buf []byte) (string, []byte, error) {
+	n, l := binary.Uvarint(buf)
+	if l <= 0 || uint64(len(buf)-l) < n {
+		return "", nil, ErrCorruptLog
+	}
+	buf = buf[l:]
+	return string(buf[:n]), buf[n:], nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("sync dir %s: %w", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package entity
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	mes "github.com/qwertyqq2/entity/message"
+)
+
+func TestOpenReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	ent, err := Open(dir, procLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newProc(1)
+	if err := p.Connect(ent); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range []Message{
+		mes.AddMessage("n1", "is n1"),
+		mes.AddMessage("n2", "is n2"),
+		mes.AddMessage("n1", "is n1 again"),
+		mes.DeleteMessage("n2"),
+	} {
+		if err := p.Send(m, ent); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ent.Shutdown()
+
+	ent, err = Open(dir, procLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ent.Shutdown()
+
+	if ent.Len() != 1 {
+		t.Fatal("wrong len", ent.Len())
+	}
+	e := ent.(*entity)
+	if in, _ := e.get("n1"); in.Data != "is n1 again" || in.Version != 2 {
+		t.Fatal("wrong value", in)
+	}
+
+	// versions go on after replay
+	in, err := e.cas(0, mes.NewInside("n1", "cas"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Version != 3 {
+		t.Fatal("wrong version", in.Version)
+	}
+}
+
+func TestReplayTornTail(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := openWal(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.append(walOp{op: mes.Add, in: mes.NewInside("n1", "is n1")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.append(walOp{op: mes.Add, in: mes.NewInside("n2", "is n2")}); err != nil {
+		t.Fatal(err)
+	}
+	w.close()
+
+	path := filepath.Join(dir, walFile)
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cut the last record in the middle
+	if err := os.Truncate(path, st.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	ent, err := Open(dir, procLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ent.Len() != 1 {
+		t.Fatal("wrong len", ent.Len())
+	}
+
+	// the log must be usable after the tail was cut
+	e := ent.(*entity)
+	if err := e.add(0, 0, mes.NewInside("n3", "is n3")); err != nil {
+		t.Fatal(err)
+	}
+	ent.Shutdown()
+
+	ent, err = Open(dir, procLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ent.Shutdown()
+	if ent.Len() != 2 {
+		t.Fatal("wrong len", ent.Len())
+	}
+}
+
+func TestReplayCorrupt(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := openWal(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"n1", "n2", "n3"} {
+		if err := w.append(walOp{op: mes.Add, in: mes.NewInside(key, "is "+key)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.close()
+
+	path := filepath.Join(dir, walFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := len(data) / 3
+
+	// a bad record with more after it is not a torn tail
+	bad := append([]byte(nil), data...)
+	bad[size+walHeaderSize] ^= 0xff
+	if err := os.WriteFile(path, bad, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir, procLimit); !errors.Is(err, ErrCorruptLog) {
+		t.Fatal("wrong err", err)
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size() != int64(len(data)) {
+		t.Fatal("log is cut", st.Size())
+	}
+
+	// a bad last record is cut
+	bad = append([]byte(nil), data...)
+	bad[2*size+walHeaderSize] ^= 0xff
+	if err := os.WriteFile(path, bad, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ent, err := Open(dir, procLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ent.Len() != 2 {
+		t.Fatal("wrong len", ent.Len())
+	}
+	ent.Shutdown()
+
+	// a header with a size past the end is cut without reading the size
+	header := make([]byte, walHeaderSize)
+	binary.LittleEndian.PutUint32(header[4:], 1<<31)
+	if err := os.WriteFile(path, append(data, header...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ent, err = Open(dir, procLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ent.Shutdown()
+	if ent.Len() != 3 {
+		t.Fatal("wrong len", ent.Len())
+	}
+	if st, err = os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	if st.Size() != int64(len(data)) {
+		t.Fatal("tail is not cut", st.Size())
+	}
+}
+
+func TestAppendClosed(t *testing.T) {
+	ent, err := Open(t.TempDir(), procLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ent.Shutdown()
+
+	e := ent.(*entity)
+	if err := e.add(0, 0, mes.NewInside("n1", "is n1")); err != ErrClosed {
+		t.Fatal("expected closed", err)
+	}
+}
+
+func TestSeqReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	open := func() *entity {
+		ent, err := Open(dir, procLimit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ent.(*entity)
+	}
+	// a resend of the write is answered but not applied
+	resend := func(e *entity) {
+		if resp := e.handleWrite(1, mes.AddMessage("n1", "old n1").WithSeq(1, 1), e.handleAdd); !resp.IsSuccess() {
+			t.Fatal("resend failed", resp)
+		}
+		if resp := e.handleWrite(1, mes.DeleteMessage("n2").WithSeq(1, 2), e.handleDelete); !resp.IsSuccess() {
+			t.Fatal("resend failed", resp)
+		}
+		if in, err := e.get("n1"); err != nil || in.Data != "new n1" {
+			t.Fatal("resend is applied", in, err)
+		}
+		if ok, _ := e.has("n2"); !ok {
+			t.Fatal("resend is applied")
+		}
+	}
+
+	e := open()
+	for _, m := range []Message{
+		mes.AddMessage("n1", "old n1").WithSeq(1, 1),
+		mes.DeleteMessage("n2").WithSeq(1, 2),
+		mes.AddMessage("n1", "new n1").WithSeq(1, 3),
+	} {
+		apply := e.handleAdd
+		if m.Op == mes.Delete {
+			apply = e.handleDelete
+		}
+		if resp := e.handleWrite(1, m, apply); !resp.IsSuccess() {
+			t.Fatal("write failed", resp)
+		}
+	}
+	// n2 is written by another process after the delete
+	if err := e.add(2, 0, mes.NewInside("n2", "is n2")); err != nil {
+		t.Fatal(err)
+	}
+	e.Shutdown()
+
+	// the sequences come back from the log
+	e = open()
+	resend(e)
+	if err := e.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	e.Shutdown()
+
+	// and from the snapshot
+	e = open()
+	defer e.Shutdown()
+	resend(e)
+}
@@ -0,0 +1,97 @@
+package entity
+
+import (
+	"context"
+	"strings"
+
+	mes "github.com/qwertyqq2/entity/message"
+)
+
+const (
+	defaultWatchBuffer = 128
+
+	// Proc of the changes that are not made by a process, such as expiry
+	NoProc = -1
+)
+
+// Change of a key
+type Event struct {
+	Key string
+
+	// Add, CAS or Delete
+	Op mes.Op
+
+	// Value before the change, zero if there was no key
+	Old Inside
+
+	// Value after the change, zero for Delete
+	New Inside
+
+	// Version of New, or of Old for Delete
+	Version uint64
+
+	// Process that made the change or NoProc
+	Proc int
+
+	// The key is deleted by its TTL
+	Expired bool
+}
+
+type watcher struct {
+	prefix string
+	ch     chan Event
+}
+
+// Watch sends the changes in the order they are applied.
+// Events are never dropped silently: if the buffer of a watcher is full,
+// the watcher is removed and its channel closed, the consumer has to read
+// the current state and watch again
+func (e *entity) Watch(ctx context.Context, prefix string) <-chan Event {
+	w := &watcher{
+		prefix: prefix,
+		ch:     make(chan Event, e.watchBuffer),
+	}
+
+	e.wlk.Lock()
+	e.watchers[w] = struct{}{}
+	e.wlk.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-e.ctx.Done():
+		}
+		e.unwatch(w)
+	}()
+
+	return w.ch
+}
+
+func (e *entity) unwatch(w *watcher) {
+	e.wlk.Lock()
+	defer e.wlk.Unlock()
+
+	if _, ok := e.watchers[w]; ok {
+		delete(e.watchers, w)
+		close(w.ch)
+	}
+}
+
+// notify is called under e.lk, so the events of a key come in the order of writes
+func (e *entity) notify(ev Event) {
+	e.wlk.Lock()
+	defer e.wlk.Unlock()
+
+	for w := range e.watchers {
+		if !strings.HasPrefix(ev.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.ch <- ev:
+		default:
+			// slow consumer
+			delete(e.watchers, w)
+			close(w.ch)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package entity
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	mes "github.com/qwertyqq2/entity/message"
+)
+
+func nextEvent(t *testing.T, ch <-chan Event) Event {
+	select {
+	case ev, ok := <-ch:
+		if !ok {
+			t.Fatal("watch is closed")
+		}
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+	return Event{}
+}
+
+func TestWatch(t *testing.T) {
+	mock := clock.NewMock()
+	ent := New(procLimit, WithClock(mock))
+	defer ent.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := ent.Watch(ctx, "user/")
+
+	p := newProc(7)
+	if err := p.Connect(ent); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []Message{
+		mes.AddMessage("other", "not watched"),
+		mes.AddMessage("user/1", "first"),
+		mes.AddMessage("user/1", "second"),
+		mes.DeleteMessage("user/1"),
+		mes.AddWithTTLMessage("user/2", "short", time.Second),
+	} {
+		if err := p.Send(m, ent); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ev := nextEvent(t, ch)
+	if ev.Key != "user/1" || ev.Op != mes.Add || ev.Proc != 7 || ev.Version != 1 || ev.Old.Key != "" {
+		t.Fatal("wrong event", ev)
+	}
+	ev = nextEvent(t, ch)
+	if ev.Old.Data != "first" || ev.New.Data != "second" || ev.Version != 2 {
+		t.Fatal("wrong event", ev)
+	}
+	ev = nextEvent(t, ch)
+	if ev.Op != mes.Delete || ev.Old.Data != "second" {
+		t.Fatal("wrong event", ev)
+	}
+	ev = nextEvent(t, ch)
+	if ev.Key != "user/2" {
+		t.Fatal("wrong event", ev)
+	}
+
+	mock.Add(time.Second)
+	ent.Len()
+	ev = nextEvent(t, ch)
+	if !ev.Expired || ev.Proc != NoProc || ev.Key != "user/2" {
+		t.Fatal("wrong event", ev)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("unexpected event")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watch is not closed")
+	}
+}
+
+func TestWatchSlowConsumer(t *testing.T) {
+	e := newEntity(procLimit, WatchBuffer(2))
+	defer e.Shutdown()
+
+	ch := e.Watch(context.Background(), "")
+	for _, key := range []string{"n1", "n2", "n3"} {
+		if err := e.add(1, 0, mes.NewInside(key, "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n := 0
+	for range ch {
+		n++
+	}
+	if n != 2 {
+		t.Fatal("wrong number of events before close", n)
+	}
+}
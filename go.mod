@@ -1,5 +1,5 @@
 module github.com/qwertyqq2/entity
 
-go 1.19
+go 1.21
 
-require github.com/benbjohnson/clock v1.3.0 // indirect
+require github.com/benbjohnson/clock v1.3.0
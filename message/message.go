@@ -1,6 +1,26 @@
 package mes
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+var (
+	ErrNotFound        = errors.New("key not found")
+	ErrVersionMismatch = errors.New("version mismatch")
+	ErrTxnOp           = errors.New("op is not allowed in txn")
+	ErrBatchOp         = errors.New("op is not allowed in batch")
+)
+
+// errors that survive the trip through a Fail message
+var knownErrors = []error{
+	ErrNotFound,
+	ErrVersionMismatch,
+	ErrTxnOp,
+	ErrBatchOp,
+}
 
 type Op int
 
@@ -12,11 +32,47 @@ const (
 	Ping
 	Success
 	Fail
+	CAS
+	Txn
+	Batch
 )
 
+var opNames = map[Op]string{
+	Add:     "add",
+	Get:     "get",
+	Has:     "has",
+	Delete:  "delete",
+	Ping:    "ping",
+	Success: "success",
+	Fail:    "fail",
+	CAS:     "cas",
+	Txn:     "txn",
+	Batch:   "batch",
+}
+
+func (o Op) String() string {
+	if name, ok := opNames[o]; ok {
+		return name
+	}
+	return fmt.Sprintf("op(%d)", int(o))
+}
+
+// LogValue logs the op by name
+func (o Op) LogValue() slog.Value {
+	return slog.StringValue(o.String())
+}
+
 type Inside struct {
 	Key  string
 	Data string
+
+	// Set by the entity for keys added with a TTL, zero means the key never expires
+	ExpiresAt time.Time
+
+	// Set by the entity, grows with every write of the key. A new key starts above
+	// the versions of every key removed before, so a version is never given out twice for a key.
+	// In a CAS request it is the version the key must have, 0 if it must not exist
+	Version uint64
 }
 
 func NewInside(key, data string) Inside {
@@ -30,15 +86,34 @@ func (in Inside) isNil() bool {
 	return in.Key == ""
 }
 
+// Expired reports whether the key is expired at now
+func (in Inside) Expired(now time.Time) bool {
+	return !in.ExpiresAt.IsZero() && !now.Before(in.ExpiresAt)
+}
+
 type Message struct {
 	Inside Inside
 
 	Op Op
+
+	// Lifetime of the key for Add, zero means forever
+	TTL time.Duration
+
+	// Operations of a Txn or Batch request, or their results in its Success response
+	Ops []Message
+
+	// Process that sent the write and its sequence number, growing with every write of the process.
+	// The entity drops a write whose Seq is not above the last one it applied for the key, zero Seq is not checked
+	Proc int
+	Seq  uint64
+
+	// Request id set by the process, the entity copies it to the response
+	ID uint64
 }
 
 func (m *Message) IsNil() bool {
 	switch m.Op {
-	case Add, Get, Has, Delete, Fail, Success, Ping:
+	case Add, Get, Has, Delete, Fail, Success, Ping, CAS, Txn, Batch:
 		return false
 	default:
 		return true
@@ -52,6 +127,52 @@ func AddMessage(key, data string) Message {
 	}
 }
 
+func AddWithTTLMessage(key, data string, ttl time.Duration) Message {
+	return Message{
+		Inside: NewInside(key, data),
+		Op:     Add,
+		TTL:    ttl,
+	}
+}
+
+func CASMessage(key, data string, version uint64) Message {
+	in := NewInside(key, data)
+	in.Version = version
+	return Message{
+		Inside: in,
+		Op:     CAS,
+	}
+}
+
+// Add, Delete and CAS messages applied all together or not at all
+func TxnMessage(ops ...Message) Message {
+	return Message{
+		Op:  Txn,
+		Ops: ops,
+	}
+}
+
+// WithSeq returns m stamped by the process proc with seq
+func (m Message) WithSeq(proc int, seq uint64) Message {
+	m.Proc, m.Seq = proc, seq
+	return m
+}
+
+// Add and Delete messages applied one by one under one lock acquisition.
+// The Success response has a Success or Fail result for every op in Ops
+func BatchMessage(ops ...Message) Message {
+	return Message{
+		Op:  Batch,
+		Ops: ops,
+	}
+}
+
+// WithID returns m with the request id
+func (m Message) WithID(id uint64) Message {
+	m.ID = id
+	return m
+}
+
 func DeleteMessage(key string) Message {
 	return Message{
 		Inside: NewInside(key, ""),
@@ -59,6 +180,20 @@ func DeleteMessage(key string) Message {
 	}
 }
 
+func GetMessage(key string) Message {
+	return Message{
+		Inside: NewInside(key, ""),
+		Op:     Get,
+	}
+}
+
+func HasMessage(key string) Message {
+	return Message{
+		Inside: NewInside(key, ""),
+		Op:     Has,
+	}
+}
+
 func PingMessage() Message {
 	return Message{
 		Inside: Inside{},
@@ -73,6 +208,14 @@ func SuccessMessage() Message {
 	}
 }
 
+// Success response carrying the stored value
+func ValueMessage(in Inside) Message {
+	return Message{
+		Inside: in,
+		Op:     Success,
+	}
+}
+
 func FailMessage(err error) Message {
 	errstr := err.Error()
 	return Message{
@@ -90,13 +233,22 @@ func (m Message) IsSuccess() bool {
 }
 
 func (m Message) Size() int {
-	return len(m.Inside.Data)
+	size := len(m.Inside.Data)
+	for _, op := range m.Ops {
+		size += op.Size()
+	}
+	return size
 }
 
 func (m Message) Error() error {
 	if m.Op != Fail {
 		return nil
 	}
+	for _, err := range knownErrors {
+		if err.Error() == m.Inside.Data {
+			return err
+		}
+	}
 	err := errors.New(m.Inside.Data)
 	return err
 }
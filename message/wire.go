@@ -0,0 +1,291 @@
+package mes
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// Wire protocol between a remote process and an entity server.
+// Frame: uint32 len(payload) | payload
+// Payload: kind | kind fields
+// Hello: varint proc id, the first frame of a connection
+// Welcome: string error, empty if the process is connected
+// Message frame: message
+// Message: op | inside | varint ttl | varint proc | uvarint seq | uvarint id | uvarint len(ops) | ops,
+// the ops of a message have no ops of their own
+// Inside: string key | string data | varint expires at, unix nano or 0 | uvarint version
+// String: uvarint len | bytes
+type FrameKind byte
+
+const (
+	FrameHello FrameKind = iota + 1
+	FrameWelcome
+	FrameMessage
+)
+
+const (
+	MaxFrameSize = 64 << 20
+	// ops of a single message
+	MaxFrameOps = 1 << 16
+
+	// kind | varint proc
+	maxHelloSize = 1 + binary.MaxVarintLen64
+)
+
+var (
+	ErrFrameTooLarge = errors.New("frame is too large")
+	ErrBadFrame      = errors.New("bad frame")
+)
+
+type Frame struct {
+	Kind FrameKind
+	Proc int
+	Err  string
+	Msg  Message
+}
+
+func HelloFrame(proc int) Frame {
+	return Frame{Kind: FrameHello, Proc: proc}
+}
+
+func WelcomeFrame(err error) Frame {
+	f := Frame{Kind: FrameWelcome}
+	if err != nil {
+		f.Err = err.Error()
+	}
+	return f
+}
+
+func MessageFrame(m Message) Frame {
+	return Frame{Kind: FrameMessage, Msg: m}
+}
+
+func WriteFrame(w io.Writer, f Frame) error {
+	if f.Kind == FrameMessage {
+		if len(f.Msg.Ops) > MaxFrameOps {
+			return ErrFrameTooLarge
+		}
+		for _, op := range f.Msg.Ops {
+			if len(op.Ops) > 0 {
+				return ErrBadFrame
+			}
+		}
+	}
+
+	buf := make([]byte, 4, 64)
+	buf = append(buf, byte(f.Kind))
+	switch f.Kind {
+	case FrameHello:
+		buf = binary.AppendVarint(buf, int64(f.Proc))
+	case FrameWelcome:
+		buf = appendString(buf, f.Err)
+	case FrameMessage:
+		buf = appendMessage(buf, f.Msg)
+	default:
+		return ErrBadFrame
+	}
+
+	if len(buf)-4 > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	binary.LittleEndian.PutUint32(buf, uint32(len(buf)-4))
+	_, err := w.Write(buf)
+	return err
+}
+
+func ReadFrame(r io.Reader) (Frame, error) {
+	payload, err := readPayload(r, MaxFrameSize)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	d := decoder{buf: payload[1:]}
+	f := Frame{Kind: FrameKind(payload[0])}
+	switch f.Kind {
+	case FrameHello:
+		f.Proc = int(d.varint())
+	case FrameWelcome:
+		f.Err = d.string()
+	case FrameMessage:
+		f.Msg = d.message(false)
+	default:
+		return Frame{}, ErrBadFrame
+	}
+	if d.err != nil {
+		return Frame{}, d.err
+	}
+	return f, nil
+}
+
+// ReadHello reads the first frame of a connection and returns the proc id.
+// A frame of any other kind is ErrBadFrame, its body is not read
+func ReadHello(r io.Reader) (int, error) {
+	payload, err := readPayload(r, maxHelloSize)
+	if err == ErrFrameTooLarge {
+		return 0, ErrBadFrame
+	}
+	if err != nil {
+		return 0, err
+	}
+	if FrameKind(payload[0]) != FrameHello {
+		return 0, ErrBadFrame
+	}
+	d := decoder{buf: payload[1:]}
+	proc := d.varint()
+	if d.err != nil {
+		return 0, d.err
+	}
+	return int(proc), nil
+}
+
+// readPayload reads a frame of at most max bytes
+func readPayload(r io.Reader, max uint32) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(header[:])
+	if size > max {
+		return nil, ErrFrameTooLarge
+	}
+	if size == 0 {
+		return nil, ErrBadFrame
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return payload, nil
+}
+
+func appendMessage(buf []byte, m Message) []byte {
+	buf = append(buf, byte(m.Op))
+	buf = appendInside(buf, m.Inside)
+	buf = binary.AppendVarint(buf, int64(m.TTL))
+	buf = binary.AppendVarint(buf, int64(m.Proc))
+	buf = binary.AppendUvarint(buf, m.Seq)
+	buf = binary.AppendUvarint(buf, m.ID)
+	buf = binary.AppendUvarint(buf, uint64(len(m.Ops)))
+	for _, op := range m.Ops {
+		buf = appendMessage(buf, op)
+	}
+	return buf
+}
+
+func appendInside(buf []byte, in Inside) []byte {
+	buf = appendString(buf, in.Key)
+	buf = appendString(buf, in.Data)
+	var expires int64
+	if !in.ExpiresAt.IsZero() {
+		expires = in.ExpiresAt.UnixNano()
+	}
+	buf = binary.AppendVarint(buf, expires)
+	return binary.AppendUvarint(buf, in.Version)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// decoder keeps the first error, the values after it are zero
+type decoder struct {
+	buf []byte
+	err error
+}
+
+// message of a frame, the ops of a nested message are a bad frame
+func (d *decoder) message(nested bool) Message {
+	var m Message
+	m.Op = Op(d.byte())
+	m.Inside = d.inside()
+	m.TTL = time.Duration(d.varint())
+	m.Proc = int(d.varint())
+	m.Seq = d.uvarint()
+	m.ID = d.uvarint()
+
+	n := d.uvarint()
+	if n == 0 {
+		return m
+	}
+	if nested || n > MaxFrameOps || n > uint64(len(d.buf)) {
+		d.fail()
+		return Message{}
+	}
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		m.Ops = append(m.Ops, d.message(true))
+	}
+	return m
+}
+
+func (d *decoder) inside() Inside {
+	var in Inside
+	in.Key = d.string()
+	in.Data = d.string()
+	if expires := d.varint(); expires != 0 {
+		in.ExpiresAt = time.Unix(0, expires)
+	}
+	in.Version = d.uvarint()
+	return in
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || len(d.buf) == 0 {
+		d.fail()
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, l := binary.Varint(d.buf)
+	if l <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[l:]
+	return v
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, l := binary.Uvarint(d.buf)
+	if l <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[l:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if n > uint64(len(d.buf)) {
+		d.fail()
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = ErrBadFrame
+	}
+}
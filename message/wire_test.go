@@ -0,0 +1,118 @@
+package mes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	frames := []Frame{
+		HelloFrame(7),
+		WelcomeFrame(nil),
+		WelcomeFrame(ErrNotFound),
+		MessageFrame(AddMessage("k1", "is k1")),
+		MessageFrame(AddWithTTLMessage("k2", "is k2", time.Minute)),
+		MessageFrame(DeleteMessage("k2").WithSeq(7, 1<<40)),
+		MessageFrame(ValueMessage(Inside{Key: "k3", Data: "is k3", ExpiresAt: time.Unix(0, 42), Version: 3})),
+		MessageFrame(TxnMessage(CASMessage("k1", "new k1", 1), DeleteMessage("k2"))),
+		MessageFrame(FailMessage(ErrVersionMismatch).WithID(1 << 50)),
+		MessageFrame(BatchMessage(AddMessage("k1", "is k1").WithSeq(7, 1), DeleteMessage("k2").WithSeq(7, 2))),
+	}
+
+	var buf bytes.Buffer
+	for _, f := range frames {
+		if err := WriteFrame(&buf, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range frames {
+		got, err := ReadFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatal("wrong frame", got, want)
+		}
+	}
+	if got, _ := ReadFrame(bytes.NewReader(nil)); got.Kind != 0 {
+		t.Fatal("expected no frame", got)
+	}
+}
+
+func TestReadBadFrame(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, MessageFrame(AddMessage("k1", "is k1"))); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+
+	if _, err := ReadFrame(bytes.NewReader(b[:len(b)-1])); err == nil {
+		t.Fatal("expected error on torn frame")
+	}
+	// key length past the end of the frame
+	b[6] = 0x7f
+	if _, err := ReadFrame(bytes.NewReader(b)); err != ErrBadFrame {
+		t.Fatal("expected bad frame", err)
+	}
+}
+
+// frame writes m without the checks of WriteFrame
+func frame(m Message) []byte {
+	buf := append(make([]byte, 4), byte(FrameMessage))
+	buf = appendMessage(buf, m)
+	binary.LittleEndian.PutUint32(buf, uint32(len(buf)-4))
+	return buf
+}
+
+func TestReadNestedOps(t *testing.T) {
+	nested := BatchMessage(BatchMessage(AddMessage("k1", "is k1")))
+	if err := WriteFrame(io.Discard, MessageFrame(nested)); err != ErrBadFrame {
+		t.Fatal("expected bad frame", err)
+	}
+	if _, err := ReadFrame(bytes.NewReader(frame(nested))); err != ErrBadFrame {
+		t.Fatal("expected bad frame", err)
+	}
+
+	// deep nesting is rejected at the second level
+	deep := AddMessage("k1", "is k1")
+	for i := 0; i < 100000; i++ {
+		deep = BatchMessage(deep)
+	}
+	if _, err := ReadFrame(bytes.NewReader(frame(deep))); err != ErrBadFrame {
+		t.Fatal("expected bad frame", err)
+	}
+
+	many := make([]Message, MaxFrameOps+1)
+	for i := range many {
+		many[i] = DeleteMessage("k1")
+	}
+	if err := WriteFrame(io.Discard, MessageFrame(BatchMessage(many...))); err != ErrFrameTooLarge {
+		t.Fatal("expected too large", err)
+	}
+	if _, err := ReadFrame(bytes.NewReader(frame(BatchMessage(many...)))); err != ErrBadFrame {
+		t.Fatal("expected bad frame", err)
+	}
+}
+
+func TestReadHello(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, HelloFrame(7)); err != nil {
+		t.Fatal(err)
+	}
+	if proc, err := ReadHello(&buf); err != nil || proc != 7 {
+		t.Fatal("wrong hello", proc, err)
+	}
+
+	// the body of a large frame is not waited for
+	header := binary.LittleEndian.AppendUint32(nil, MaxFrameSize)
+	if _, err := ReadHello(bytes.NewReader(header)); err != ErrBadFrame {
+		t.Fatal("expected bad frame", err)
+	}
+	if _, err := ReadHello(bytes.NewReader(frame(AddMessage("k1", "is k1")))); err != ErrBadFrame {
+		t.Fatal("expected bad frame", err)
+	}
+}
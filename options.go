@@ -10,4 +10,5 @@ const (
 	WaitSendInterval     = 3 * time.Second
 	ReconnectInterval    = 1 * time.Second
 	MaxWaitingConnection = 100 * time.Second
+	MaxInFlight          = 1
 )
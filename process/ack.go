@@ -0,0 +1,121 @@
+package process
+
+import (
+	"context"
+	"sync"
+)
+
+// Handle of a write, resolved when the entity answers it
+type Ack interface {
+	// Closed when the ack is resolved
+	Done() <-chan struct{}
+
+	// Waits until the ack is resolved and returns Err
+	Wait() error
+
+	// Nil if the entity applied the write, the error of the entity if it failed it,
+	// the error of the context or ErrShutdownProcess if the answer did not come before them
+	Err() error
+}
+
+type ack struct {
+	ctx  context.Context
+	done chan struct{}
+	once sync.Once
+	err  error
+	// forgets the ack in the process
+	release func(a *ack)
+}
+
+func (a *ack) Done() <-chan struct{} {
+	return a.done
+}
+
+func (a *ack) Wait() error {
+	<-a.done
+	return a.err
+}
+
+func (a *ack) Err() error {
+	select {
+	case <-a.done:
+		return a.err
+	default:
+		return nil
+	}
+}
+
+func (a *ack) resolve(err error) {
+	a.once.Do(func() {
+		a.err = err
+		close(a.done)
+		a.release(a)
+	})
+}
+
+// canceled is true if nobody waits for the ack anymore
+func (a *ack) canceled() bool {
+	return a.ctx.Err() != nil
+}
+
+// newAck returns an ack that is resolved with the error of ctx when it is done.
+// Shutdown resolves all acks that are left
+func (p *impl) newAck(ctx context.Context) *ack {
+	a := &ack{
+		ctx:     ctx,
+		done:    make(chan struct{}),
+		release: p.releaseAck,
+	}
+	p.ak.Lock()
+	p.acks[a] = struct{}{}
+	p.ak.Unlock()
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				a.resolve(ctx.Err())
+			case <-a.done:
+			}
+		}()
+	}
+	return a
+}
+
+func (p *impl) releaseAck(a *ack) {
+	p.ak.Lock()
+	delete(p.acks, a)
+	p.ak.Unlock()
+}
+
+// resolveAcks resolves the acks that are still waiting with err
+func (p *impl) resolveAcks(err error) {
+	p.ak.Lock()
+	acks := make([]*ack, 0, len(p.acks))
+	for a := range p.acks {
+		acks = append(acks, a)
+	}
+	p.ak.Unlock()
+
+	for _, a := range acks {
+		a.resolve(err)
+	}
+}
+
+// mergeAcks returns the acks of both entries without repeats, the slices are not changed
+func mergeAcks(acks, other []*ack) []*ack {
+	merged := acks[:len(acks):len(acks)]
+	for _, a := range other {
+		found := false
+		for _, b := range acks {
+			if a == b {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, a)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,161 @@
+package process
+
+import (
+	"time"
+
+	"github.com/benbjohnson/clock"
+	mes "github.com/qwertyqq2/entity/message"
+)
+
+// Message sent to the entity and waiting for the response with its request id
+type flight struct {
+	msg mes.Message
+	// entries of a write, they are resolved with the results of the response
+	entries []Entry
+	timer   *clock.Timer
+	// when the message was sent, for the latency in the log
+	sent time.Time
+	// response of a request, nil for a write
+	resp chan mes.Message
+}
+
+func (p *impl) nextReqID() uint64 {
+	return p.reqID.Add(1)
+}
+
+// windowOpen is true while less than MaxInFlight writes wait for their responses
+func (p *impl) windowOpen() bool {
+	max := p.config().MaxInFlight
+
+	p.fk.Lock()
+	defer p.fk.Unlock()
+	return p.writes < max
+}
+
+// takeOff registers f under a new request id before it is sent.
+// A write expires if its response does not come in wait
+func (p *impl) takeOff(f *flight, wait time.Duration) uint64 {
+	id := p.nextReqID()
+	f.msg.ID = id
+	f.sent = p.clock.Now()
+
+	p.fk.Lock()
+	defer p.fk.Unlock()
+	p.flights[id] = f
+	if f.entries != nil {
+		p.writes++
+		f.timer = p.clock.AfterFunc(wait, func() { p.expire(id) })
+	}
+	return id
+}
+
+// forget removes the flight, false if it has already landed or expired
+func (p *impl) forget(id uint64) (*flight, bool) {
+	p.fk.Lock()
+	defer p.fk.Unlock()
+
+	f, ok := p.flights[id]
+	if !ok {
+		return nil, false
+	}
+	delete(p.flights, id)
+	if f.entries != nil {
+		p.writes--
+	}
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+	return f, true
+}
+
+// readResponses hands the responses of ent to their flights until stop is closed.
+// Responses that match no flight came after its timeout and are dropped
+func (p *impl) readResponses(ent Transport, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-p.ctx.Done():
+			return
+		default:
+		}
+
+		resp := ent.Resp(p.id)
+		if resp.IsNil() {
+			continue
+		}
+		f, ok := p.forget(resp.ID)
+		if !ok {
+			continue
+		}
+		if f.resp != nil {
+			f.resp <- resp
+			continue
+		}
+		p.land(f, resp)
+	}
+}
+
+// land resolves the entries of the write with the response
+func (p *impl) land(f *flight, resp mes.Message) {
+	results := p.results(f.msg, resp, len(f.entries))
+
+	p.wk.Lock()
+	failed := make([]Entry, 0)
+	for i, e := range f.entries {
+		if err := p.handleResult(e, results[i]); err != nil {
+			e.err = err
+			failed = append(failed, e)
+		}
+	}
+	p.updateDepth()
+	p.wk.Unlock()
+
+	p.logger.Debug("response", "proc", p.id, "id", resp.ID, "op", resp.Op, "entries", len(f.entries),
+		"failed", len(failed), "latency", p.clock.Since(f.sent))
+	for _, e := range failed {
+		p.logger.Warn("write failed", "proc", p.id, "op", e.op, "key", e.key, "err", e.err)
+	}
+	if p.onFailed != nil {
+		for _, e := range failed {
+			p.onFailed(e, e.err)
+		}
+	}
+	p.signalLanded()
+}
+
+// expire puts the entries of a write without response back to the wantlist
+// and makes the run loop reconnect
+func (p *impl) expire(id uint64) {
+	f, ok := p.forget(id)
+	if !ok {
+		return
+	}
+	p.resent.Add(uint64(len(f.entries)))
+	p.logger.Warn("no response", "proc", p.id, "id", id, "entries", len(f.entries),
+		"latency", p.clock.Since(f.sent))
+
+	p.wk.Lock()
+	for _, e := range f.entries {
+		p.requeue(e)
+	}
+	p.updateDepth()
+	p.wk.Unlock()
+
+	p.signalTimedOut()
+}
+
+// signalTimedOut makes the run loop reconnect, the session may be gone
+func (p *impl) signalTimedOut() {
+	select {
+	case p.timedOut <- struct{}{}:
+	default:
+	}
+}
+
+func (p *impl) signalLanded() {
+	select {
+	case p.landed <- struct{}{}:
+	default:
+	}
+}
@@ -4,13 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/benbjohnson/clock"
-	opts "github.com/qwertyqq2/entity"
-	"github.com/qwertyqq2/entity/entity"
 	mes "github.com/qwertyqq2/entity/message"
 )
 
@@ -18,6 +17,10 @@ var (
 	ErrShutdownProcess = errors.New("process is closed")
 	ErrTimeoutSend     = errors.New("timeout send")
 	ErrNilMsg          = errors.New("nil mes err")
+	ErrNotRegistered   = errors.New("process is not registered")
+	ErrNotFound        = mes.ErrNotFound
+	ErrVersionMismatch = mes.ErrVersionMismatch
+	ErrTxnOp           = mes.ErrTxnOp
 )
 
 type recall struct {
@@ -31,24 +34,44 @@ func (r *recall) Add(op mes.Op, data mes.Inside) {
 	r.want.Add(data.Key, op, data)
 }
 
+func (r *recall) AddEntry(e Entry) {
+	r.want.AddEntry(e)
+}
+
+// Push adds a new write of the process, it replaces an unsent write of the key
+func (r *recall) Push(e Entry) {
+	r.want.Replace(e)
+}
+
 func (r *recall) Remove(key string) {
 	r.want.Remove(key)
 	r.sent.Remove(key)
 	delete(r.sentAt, key)
 }
 
+// RemoveEntry removes the write e, a newer write of the key is kept
+func (r *recall) RemoveEntry(e Entry) {
+	r.want.RemoveEntry(e)
+	if r.sent.RemoveEntry(e) {
+		delete(r.sentAt, e.data.Key)
+	}
+}
+
 func (r *recall) MarkSent(key string) bool {
 	e, ok := r.want.Contains(key)
 	if !ok {
 		return false
 	}
 
-	r.sent.Add(key, e.op, e.data)
+	r.sent.AddEntry(e)
 	return true
 }
 
-func (r *recall) MarkUndefined(op mes.Op, data mes.Inside) {
-	r.undefined.Add(data.Key, op, data)
+// MarkUndefined parks the failed entry as a dead letter, a later failure of the key replaces it
+func (r *recall) MarkUndefined(e Entry, err error) {
+	e.undefined = true
+	e.err = err
+	r.undefined.Replace(e)
 }
 
 func (r *recall) SentAt(key string, at time.Time) {
@@ -91,59 +114,195 @@ type impl struct {
 	ctx      context.Context
 	shutdown func()
 
+	// buffered so that a signal sent while the run loop is busy is not lost
 	outgoingWork chan time.Time
+	flushWork    chan struct{}
 	disconnected chan struct{}
 
 	ek       sync.RWMutex
 	entityCh chan<- mes.Message
-	ent      entity.Entity
+	ent      Transport
 
-	clock clock.Clock
+	clock  clock.Clock
+	logger *slog.Logger
 
 	wk     sync.RWMutex
 	recall recall
 
-	lk                   sync.RWMutex
-	maxMsgSize           int
-	sendMsgCutoff        int
-	maxWaitingConnection time.Duration
-	sendMessageMaxDelay  time.Duration
-	reconnectInterval    time.Duration
-	resendInterval       time.Duration
-	waitRespInterval     time.Duration
-	waitRespTimer        *clock.Timer
-	resendTimer          *clock.Timer
+	lk          sync.RWMutex
+	cfg         Options
+	resendTimer *clock.Timer
+
+	sent     atomic.Uint64
+	acked    atomic.Uint64
+	failed   atomic.Uint64
+	resent   atomic.Uint64
+	pending  atomic.Int64
+	inFlight atomic.Int64
+
+	ak   sync.Mutex
+	acks map[*ack]struct{}
+
+	// guards recall.undefined
+	dk       sync.Mutex
+	onFailed func(e Entry, err error)
+
+	jk            sync.Mutex
+	journalPath   string
+	syncJournal   bool
+	journal       *journal
+	journalClosed bool
+
+	// last sequence number given to a write
+	seq atomic.Uint64
+
+	reqID atomic.Uint64
+	fk    sync.Mutex
+	// messages waiting for their responses by request id
+	flights map[uint64]*flight
+	// writes in flights
+	writes int
+	// stops the reader of the responses of the last registration
+	stopReader chan struct{}
+	// a write has got its response
+	landed chan struct{}
+	// a write has got no response in time
+	timedOut chan struct{}
+
+	pk sync.Mutex
+	// closed and replaced once the wantlists change, Flush waits on it
+	progress chan struct{}
 }
 
 func newProc(id int) *impl {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	clock := clock.New()
+	p := &impl{
+		id:           id,
+		ctx:          ctx,
+		shutdown:     cancel,
+		outgoingWork: make(chan time.Time, 1),
+		flushWork:    make(chan struct{}, 1),
+		clock:        clock.New(),
+		logger:       discardLogger(),
+		recall:       newRecall(),
+		cfg:          DefaultOptions(),
+		queue:        newQueue(),
+		flights:      make(map[uint64]*flight),
+		landed:       make(chan struct{}, 1),
+		timedOut:     make(chan struct{}, 1),
+		progress:     make(chan struct{}),
+		disconnected: make(chan struct{}),
+		acks:         make(map[*ack]struct{}),
+	}
+	p.seedSeq()
+	return p
+}
 
-	resendTimer := clock.Timer(opts.ResentInterval)
+// seedSeq starts the sequences from the clock of the process.
+// The entity keeps the sequences of the process after it restarts,
+// starting from the clock numbers the new writes above the old ones.
+// The journal raises them above the ones it has given out, see raiseSeq
+func (p *impl) seedSeq() {
+	p.seq.Store(uint64(p.clock.Now().UnixNano()))
+}
 
-	return &impl{
-		id:               id,
-		ctx:              ctx,
-		shutdown:         cancel,
-		outgoingWork:     make(chan time.Time),
-		clock:            clock,
-		recall:           newRecall(),
-		resendInterval:   opts.ResentInterval,
-		resendTimer:      resendTimer,
-		queue:            newQueue(),
-		waitRespInterval: opts.WaitSendInterval,
-		waitRespTimer:    clock.Timer(opts.WaitSendInterval),
-		disconnected:     make(chan struct{}),
+// raiseSeq makes the next sequences go on above seq
+func (p *impl) raiseSeq(seq uint64) {
+	for {
+		cur := p.seq.Load()
+		if cur >= seq || p.seq.CompareAndSwap(cur, seq) {
+			return
+		}
 	}
 }
 
+func (p *impl) nextSeq() uint64 {
+	return p.seq.Add(1)
+}
+
 func (p *impl) Shutdown() {
 	p.queue.Shutdown()
 	p.shutdown()
+	p.resolveAcks(ErrShutdownProcess)
+	p.closeJournal()
+}
+
+// Flush makes the run loop send without waiting for the batch to fill up
+// and returns when the entity has answered every entry added before
+func (p *impl) Flush(ctx context.Context) error {
+	for {
+		// taken before the check, a change after it is not missed
+		progress := p.progressed()
+		if p.ctx.Err() != nil {
+			return ErrShutdownProcess
+		}
+		if p.drained() {
+			return nil
+		}
+		select {
+		case p.flushWork <- struct{}{}:
+		default:
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.ctx.Done():
+			return ErrShutdownProcess
+		case <-progress:
+		}
+	}
+}
+
+// progressed returns the channel that is closed once the wantlists change
+func (p *impl) progressed() <-chan struct{} {
+	p.pk.Lock()
+	defer p.pk.Unlock()
+	return p.progress
+}
+
+func (p *impl) signalProgress() {
+	p.pk.Lock()
+	defer p.pk.Unlock()
+	close(p.progress)
+	p.progress = make(chan struct{})
+}
+
+// drained is true when nothing is queued, waiting to be sent or in flight.
+// The sent wantlist keeps one entry of a key, a newer write of the key is in the flights only
+func (p *impl) drained() bool {
+	if p.queue.Len() > 0 {
+		return false
+	}
+	p.fk.Lock()
+	writes := p.writes
+	p.fk.Unlock()
+	if writes > 0 {
+		return false
+	}
+
+	p.wk.RLock()
+	defer p.wk.RUnlock()
+	return p.recall.want.Len() == 0 && p.recall.sent.Len() == 0
+}
+
+// Close flushes the process, disconnects it from the entity and shuts it down.
+// The process is shut down even if ctx is done before the flush, then the error of ctx is returned
+func (p *impl) Close(ctx context.Context) error {
+	err := p.Flush(ctx)
+
+	p.ek.RLock()
+	ent := p.ent
+	p.ek.RUnlock()
+	if ent != nil {
+		ent.Disconnect(p.id)
+	}
+	p.Shutdown()
+	return err
 }
 
-func (p *impl) Registration(ent entity.Entity) error {
+func (p *impl) Registration(ent Transport) error {
 	p.ek.Lock()
 	defer p.ek.Unlock()
 	ch, err := ent.Connect(p.id)
@@ -152,24 +311,156 @@ func (p *impl) Registration(ent entity.Entity) error {
 	}
 	p.entityCh = ch
 	p.ent = ent
+
+	if p.stopReader != nil {
+		close(p.stopReader)
+	}
+	p.stopReader = make(chan struct{})
+	go p.readResponses(ent, p.stopReader)
 	return nil
 }
 
-func (p *impl) Start(ent entity.Entity) error {
+func (p *impl) Start(ent Transport) error {
+	cfg := p.config()
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
 	if err := p.Registration(ent); err != nil {
 		return err
 	}
+	if err := p.replayJournal(); err != nil {
+		return err
+	}
+
+	p.lk.Lock()
+	p.resendTimer = p.clock.Timer(cfg.ResentInterval)
+	p.lk.Unlock()
+
 	go p.queueIncomig()
 	go p.run()
 	return nil
 }
 
+// config returns the options of the process
+func (p *impl) config() Options {
+	p.lk.RLock()
+	defer p.lk.RUnlock()
+
+	return p.cfg
+}
+
 func (p *impl) Add(key, data string) {
-	p.queue.Push(Entry{op: mes.Add, data: mes.NewInside(key, data)})
+	p.enqueue(Entry{op: mes.Add, data: mes.NewInside(key, data)})
+}
+
+func (p *impl) AddWithTTL(key, data string, ttl time.Duration) {
+	p.enqueue(Entry{op: mes.Add, data: mes.NewInside(key, data), ttl: ttl})
 }
 
 func (p *impl) Delete(key string) {
-	p.queue.Push(Entry{op: mes.Delete, data: mes.NewInside(key, "")})
+	p.enqueue(Entry{op: mes.Delete, data: mes.NewInside(key, "")})
+}
+
+// enqueue writes e to the journal if there is one and pushes it to the queue
+func (p *impl) enqueue(e Entry) error {
+	if err := p.journalAdd(&e); err != nil {
+		p.logger.Error("journal add", "proc", p.id, "op", e.op, "key", e.data.Key, "err", err)
+		return err
+	}
+	p.queue.Push(e)
+	return nil
+}
+
+func (p *impl) AddCtx(ctx context.Context, key, data string) (Ack, error) {
+	return p.push(ctx, Entry{op: mes.Add, data: mes.NewInside(key, data)})
+}
+
+func (p *impl) DeleteCtx(ctx context.Context, key string) (Ack, error) {
+	return p.push(ctx, Entry{op: mes.Delete, data: mes.NewInside(key, "")})
+}
+
+// push queues e with an ack bound to ctx
+func (p *impl) push(ctx context.Context, e Entry) (Ack, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if p.ctx.Err() != nil {
+		return nil, ErrShutdownProcess
+	}
+	a := p.newAck(ctx)
+	e.acks = []*ack{a}
+	if err := p.enqueue(e); err != nil {
+		a.resolve(err)
+		return nil, err
+	}
+	return a, nil
+}
+
+func (p *impl) Get(key string) (mes.Inside, error) {
+	resp, err := p.request(mes.GetMessage(key))
+	if err != nil {
+		return mes.Inside{}, err
+	}
+	return resp.Inside, nil
+}
+
+func (p *impl) Has(key string) (bool, error) {
+	_, err := p.request(mes.HasMessage(key))
+	switch err {
+	case nil:
+		return true, nil
+	case ErrNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (p *impl) CompareAndSwap(key string, expectedVersion uint64, data string) (uint64, error) {
+	resp, err := p.request(mes.CASMessage(key, data, expectedVersion))
+	if err != nil {
+		return 0, err
+	}
+	return resp.Inside.Version, nil
+}
+
+// request sends the message bypassing the wantlists and waits for the response
+// that readResponses hands over by the request id.
+// A request without response makes the run loop reconnect like an expired write
+func (p *impl) request(m mes.Message) (mes.Message, error) {
+	p.ek.RLock()
+	ch, ent := p.entityCh, p.ent
+	p.ek.RUnlock()
+	if ent == nil {
+		return mes.Message{}, ErrNotRegistered
+	}
+
+	waitResp := p.config().WaitRespInterval
+	timeout := p.clock.Timer(waitResp)
+	defer timeout.Stop()
+
+	f := &flight{msg: m, resp: make(chan mes.Message, 1)}
+	id := p.takeOff(f, waitResp)
+	defer p.forget(id)
+
+	select {
+	case <-p.ctx.Done():
+		return mes.Message{}, ErrShutdownProcess
+	case <-timeout.C:
+		p.signalTimedOut()
+		return mes.Message{}, ErrTimeoutSend
+	case ch <- f.msg:
+	}
+
+	select {
+	case <-p.ctx.Done():
+		return mes.Message{}, ErrShutdownProcess
+	case <-timeout.C:
+		p.signalTimedOut()
+		return mes.Message{}, ErrTimeoutSend
+	case resp := <-f.resp:
+		return resp, resp.Error()
+	}
 }
 
 func (p *impl) run() {
@@ -180,30 +471,51 @@ func (p *impl) run() {
 		<-scheduleWork.C
 	}
 
+	p.lk.RLock()
+	resendTimer := p.resendTimer
+	p.lk.RUnlock()
+
+	// the first work that is not sent yet
 	var workScheduled time.Time
 	for p.ctx.Err() == nil {
 		select {
-		case <-p.resendTimer.C:
-			p.resendTimer.Reset(opts.ResentInterval)
+		case <-resendTimer.C:
+			resendTimer.Reset(p.config().ResentInterval)
 			p.sendIfReady()
 
 		case when := <-p.outgoingWork:
+			cfg := p.config()
 			if workScheduled.IsZero() {
 				workScheduled = when
 			} else if !scheduleWork.Stop() {
-				<-scheduleWork.C
+				select {
+				case <-scheduleWork.C:
+				default:
+				}
 			}
-			if p.pendingCount() > opts.SendMsgCutoff || p.clock.Since(workScheduled) >= opts.SendMessageMaxDelay {
+			// a full batch or work that has waited long enough is sent,
+			// the rest waits for the time left of SendMessageMaxDelay
+			waited := p.clock.Since(workScheduled)
+			if p.pendingCount() > cfg.SendMsgCutoff || waited >= cfg.SendMessageMaxDelay {
 				p.sendIfReady()
 				workScheduled = time.Time{}
 			} else {
-				scheduleWork.Reset(opts.SendMessageMaxDelay)
+				scheduleWork.Reset(cfg.SendMessageMaxDelay - waited)
 			}
 
 		case <-scheduleWork.C:
 			workScheduled = time.Time{}
 			p.sendIfReady()
 
+		case <-p.flushWork:
+			p.sendIfReady()
+
+		case <-p.landed:
+			p.sendIfReady()
+
+		case <-p.timedOut:
+			p.handleError(ErrTimeoutSend)
+
 		case <-p.ctx.Done():
 			return
 
@@ -220,23 +532,12 @@ func (p *impl) queueIncomig() {
 	for p.queue.wait() {
 		ins := p.queue.pull()
 		p.wk.Lock()
-		if e, ok := p.recall.want.Contains(ins.key); ok {
-			if e.Empty() {
-				p.recall.Remove(ins.key)
-			}
-			continue
-		}
-
-		if e, ok := p.recall.sent.Contains(ins.key); ok && !e.Empty() {
-			if e.Empty() {
-				p.recall.Remove(ins.key)
-			}
-			continue
-		}
+		// a newer write of a wanted key replaces it, a sent one is answered on its own
+		p.recall.Push(ins)
+		p.queue.processed()
+		p.updateDepth()
 		p.wk.Unlock()
 
-		p.recall.Add(ins.op, ins.data)
-
 		select {
 		case <-p.ctx.Done():
 			return
@@ -251,7 +552,7 @@ func (p *impl) SetResentInterval(delay time.Duration) {
 	p.lk.Lock()
 	defer p.lk.Unlock()
 
-	p.resendInterval = delay
+	p.cfg.ResentInterval = delay
 	if p.resendTimer == nil {
 		return
 	}
@@ -262,12 +563,42 @@ func (p *impl) SetWaitRespInterval(delay time.Duration) {
 	p.lk.Lock()
 	defer p.lk.Unlock()
 
-	p.waitRespInterval = delay
+	p.cfg.WaitRespInterval = delay
+}
+
+// Options returns the options the process runs with
+func (p *impl) Options() Options {
+	return p.config()
+}
+
+// Reconfigure swaps the options of a running process.
+// Writes in flight keep the wait of the options they were sent with,
+// queued entries are sent with the new ones
+func (p *impl) Reconfigure(o Options) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	if p.ctx.Err() != nil {
+		return ErrShutdownProcess
+	}
+
+	p.lk.Lock()
+	p.cfg = o
+	if p.resendTimer != nil {
+		p.resendTimer.Reset(o.ResentInterval)
+	}
+	p.lk.Unlock()
+
+	// the run loop checks the queued work against the new cutoff and delay
+	// and a wider window is filled
+	p.signalWorkReady()
+	p.signalLanded()
+	return nil
 }
 
 func (p *impl) resentWithTransfer() {
 	p.lk.RLock()
-	p.resendTimer.Reset(p.resendInterval)
+	p.resendTimer.Reset(p.cfg.ResentInterval)
 	p.lk.RUnlock()
 
 	if p.transferResent() {
@@ -277,16 +608,17 @@ func (p *impl) resentWithTransfer() {
 	}
 }
 
+// sendIfReady sends the wanted entries while the window of MaxInFlight writes is open
 func (p *impl) sendIfReady() {
-	if p.hasPendingWork() {
+	for p.hasPendingWork() && p.windowOpen() {
 		if err := p.sendMessage(); err != nil {
 			p.handleError(err)
+			return
 		}
 	}
 }
 
 func (p *impl) handleError(err error) {
-	log.Println("handle error")
 	select {
 	case <-p.ctx.Done():
 		return
@@ -294,14 +626,20 @@ func (p *impl) handleError(err error) {
 	}
 	switch err {
 	case ErrTimeoutSend:
-		after := time.After(p.maxWaitingConnection)
+		cfg := p.config()
+		p.ek.RLock()
+		ent := p.ent
+		p.ek.RUnlock()
+		p.logger.Warn("reconnect", "proc", p.id, "err", err)
+		after := p.clock.Timer(cfg.MaxWaitingConnection)
+		defer after.Stop()
 		reconnTimer := p.clock.Timer(0)
 
 		if !reconnTimer.Stop() {
 			<-reconnTimer.C
 		}
-		if err := p.Registration(p.ent); err != nil {
-			reconnTimer.Reset(p.reconnectInterval)
+		if err := p.Registration(ent); err != nil {
+			reconnTimer.Reset(cfg.ReconnectInterval)
 		} else {
 			goto Connection
 		}
@@ -310,18 +648,20 @@ func (p *impl) handleError(err error) {
 			case <-p.ctx.Done():
 				return
 
-			case <-after:
+			case <-after.C:
+				p.logger.Error("connection lost, shutting down", "proc", p.id, "waited", cfg.MaxWaitingConnection)
 				p.Shutdown()
 
 			case <-reconnTimer.C:
-				if err := p.Registration(p.ent); err != nil {
-					reconnTimer.Reset(p.reconnectInterval)
+				if err := p.Registration(ent); err != nil {
+					reconnTimer.Reset(cfg.ReconnectInterval)
 					continue
 				}
 				goto Connection
 			}
 		}
 	Connection:
+		p.logger.Info("reconnected", "proc", p.id)
 		p.sendIfReady()
 
 	default:
@@ -336,98 +676,137 @@ func (p *impl) sendMessage() error {
 	var (
 		msgSize     = 0
 		sentEntries = 0
+		maxMsgSize  = p.config().MaxMsgSize
 	)
 
 	msgs := make([]mes.Message, 0)
+	batch := make([]Entry, 0)
 
 	for _, e := range entires {
 		p.wk.Lock()
+		if e.canceled() {
+			p.recall.want.Remove(e.key)
+			p.wk.Unlock()
+			p.journalDone(e)
+			continue
+		}
 		if !p.recall.MarkSent(e.key) {
 			p.recall.want.Remove(e.key)
+			p.wk.Unlock()
 			continue
 		}
 		p.wk.Unlock()
 
-		msg := mes.Message{
-			Inside: e.data,
-			Op:     e.op,
-		}
+		msg := e.message().WithSeq(p.id, e.seq)
 		msgSize += msg.Size()
 		sentEntries++
 		msgs = append(msgs, msg)
-
-		if msgSize > p.maxMsgSize {
-			break
-		}
+		batch = append(batch, e)
 
 		p.wk.Lock()
 		p.recall.want.Remove(msg.Inside.Key)
-		p.recall.sent.Add(msg.Inside.Key, msg.Op, msg.Inside)
+		p.recall.sent.AddEntry(e)
 		p.wk.Unlock()
+
+		// at 0 also a delete or an entry without data goes alone
+		if maxMsgSize == 0 || msgSize > maxMsgSize || len(msgs) == mes.MaxFrameOps {
+			break
+		}
 	}
 
 	if len(msgs) == 0 {
+		// canceled entries may have left the wantlist
+		p.wk.Lock()
+		p.updateDepth()
+		p.wk.Unlock()
 		return ErrNilMsg
 	}
 
 	p.wk.Lock()
-	defer p.wk.Unlock()
-	log.Println("send")
-	for _, m := range msgs {
-		select {
-		case <-p.ctx.Done():
-			return ErrShutdownProcess
-
-		case p.entityCh <- m:
-			done := make(chan struct{})
-			p.recall.SentAt(m.Inside.Key, p.clock.Now())
+	now := p.clock.Now()
+	for _, e := range batch {
+		p.recall.SentAt(e.key, now)
+	}
+	p.updateDepth()
+	p.wk.Unlock()
 
-			if !p.waitRespTimer.Stop() {
-				<-p.waitRespTimer.C
-			}
+	f := &flight{msg: msgs[0], entries: batch}
+	if len(msgs) > 1 {
+		f.msg = mes.BatchMessage(msgs...)
+	}
+	p.takeOff(f, p.config().WaitRespInterval)
 
-			go func() {
-				doneFn := func() {
-					select {
-					case done <- struct{}{}:
-					}
-				}
-				resp := p.ent.Resp(p.id)
-				p.recall.ClearSentAt(m.Inside.Key)
-				switch resp.Op {
-				case mes.Success:
-					p.recall.Remove(m.Inside.Key)
-					doneFn()
-				case mes.Fail:
-					p.recall.MarkUndefined(m.Op, m.Inside)
-					p.recall.sent.Remove(m.Inside.Key)
-					doneFn()
-				default:
-					p.recall.want.Add(m.Inside.Key, m.Op, m.Inside)
-					p.recall.sent.Remove(m.Inside.Key)
-				}
-			}()
+	p.ek.RLock()
+	ch := p.entityCh
+	p.ek.RUnlock()
+	// counted before the response can land
+	p.sent.Add(uint64(len(batch)))
+	select {
+	case <-p.ctx.Done():
+		return ErrShutdownProcess
 
-			p.waitRespTimer.Reset(p.waitRespInterval)
+	case ch <- f.msg:
+	}
+	p.logger.Debug("send", "proc", p.id, "id", f.msg.ID, "op", f.msg.Op, "entries", len(batch),
+		"size", msgSize, "pending", p.pending.Load())
+	return nil
+}
 
-			select {
-			case <-done:
-				p.waitRespTimer.Reset(p.waitRespInterval)
-
-			// entity not work with you
-			case <-p.waitRespTimer.C:
-				p.recall.want.Add(m.Inside.Key, m.Op, m.Inside)
-				p.recall.sent.Remove(m.Inside.Key)
-				return ErrTimeoutSend
-			}
+// results returns the result for every of the n entries sent in m.
+// A Batch is answered with a result for every op, any other response stands for all entries
+func (p *impl) results(m, resp mes.Message, n int) []mes.Message {
+	if m.Op == mes.Batch && resp.Op == mes.Success {
+		if len(resp.Ops) == n {
+			return resp.Ops
 		}
+		// the entries are sent again
+		resp = mes.Message{}
+	}
+	results := make([]mes.Message, n)
+	for i := range results {
+		results[i] = resp
+	}
+	return results
+}
+
+// handleResult resolves the sent entry with the result of the entity and returns its error
+// for a failed entry, without a result the entry goes back to the wantlist.
+// Only the entry of the same write is taken out of the wantlists. p.wk must be held
+func (p *impl) handleResult(e Entry, resp mes.Message) error {
+	switch resp.Op {
+	case mes.Success:
+		p.acked.Add(1)
+		p.recall.RemoveEntry(e)
+		p.journalDone(e)
+		e.resolve(nil)
+
+	case mes.Fail:
+		p.failed.Add(1)
+		err := resp.Error()
+		e.resolve(err)
+		p.dk.Lock()
+		p.recall.MarkUndefined(e, err)
+		p.dk.Unlock()
+		p.recall.RemoveEntry(e)
+		p.journalDone(e)
+		return err
+
+	default:
+		p.requeue(e)
 	}
-	p.logSendingMessage(msgs)
 	return nil
 }
 
+// requeue puts the sent entry back to the wantlist to be sent again
+func (p *impl) requeue(e Entry) {
+	if p.recall.sent.RemoveEntry(e) {
+		p.recall.ClearSentAt(e.key)
+	}
+	p.recall.want.AddEntry(e)
+}
+
 func (p *impl) hasPendingWork() bool {
-	return p.recall.want.Len() > 0
+	return p.pendingCount() > 0
 }
 
 func (p *impl) transferResent() bool {
@@ -437,11 +816,15 @@ func (p *impl) transferResent() bool {
 	if p.recall.sent.Len() == 0 {
 		return false
 	}
+	p.resent.Add(uint64(p.recall.sent.Len()))
 	p.recall.want.Absorf(p.recall.sent)
+	p.updateDepth()
 	return true
 }
 
 func (p *impl) pendingCount() int {
+	p.wk.RLock()
+	defer p.wk.RUnlock()
 	return p.recall.want.Len()
 }
 
@@ -452,11 +835,64 @@ func (p *impl) signalWorkReady() {
 	}
 }
 
-func (p *impl) ID() int {
-	return p.id
+func (p *impl) Stats() Stats {
+	return Stats{
+		Sent:     p.sent.Load(),
+		Acked:    p.acked.Load(),
+		Failed:   p.failed.Load(),
+		Resent:   p.resent.Load(),
+		Queued:   p.queue.Len(),
+		Pending:  int(p.pending.Load()),
+		InFlight: int(p.inFlight.Load()),
+	}
+}
+
+func (p *impl) DeadLetters() []Entry {
+	p.dk.Lock()
+	defer p.dk.Unlock()
+
+	return append([]Entry(nil), p.recall.undefined.Entries()...)
 }
 
-func (p *impl) logSendingMessage(msgs []entity.Message) {
-	res := fmt.Sprintf("sending: %d, want: %d, undefined: %d\n", len(msgs), p.recall.want.Len(), p.recall.undefined.Len())
-	log.Println(res)
+func (p *impl) RetryDeadLetters() int {
+	p.dk.Lock()
+	entries := p.recall.undefined.Entries()
+	p.recall.undefined = NewWantlist()
+	p.dk.Unlock()
+	if len(entries) == 0 {
+		return 0
+	}
+
+	for i := range entries {
+		e := &entries[i]
+		e.undefined = false
+		e.err = nil
+		e.acks = nil
+		// the answered entry is written again with a new sequence
+		if err := p.journalAdd(e); err != nil {
+			p.logger.Error("journal add", "proc", p.id, "op", e.op, "key", e.key, "err", err)
+		}
+	}
+
+	p.wk.Lock()
+	for _, e := range entries {
+		// a newer write of the key is kept
+		p.recall.AddEntry(e)
+	}
+	p.updateDepth()
+	p.wk.Unlock()
+
+	p.signalWorkReady()
+	return len(entries)
+}
+
+// updateDepth saves the lengths of the wantlists for Stats and wakes up Flush, wk must be held
+func (p *impl) updateDepth() {
+	p.pending.Store(int64(p.recall.want.Len()))
+	p.inFlight.Store(int64(p.recall.sent.Len()))
+	p.signalProgress()
+}
+
+func (p *impl) ID() int {
+	return p.id
 }
@@ -0,0 +1,486 @@
+package process
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	mes "github.com/qwertyqq2/entity/message"
+)
+
+const (
+	// crc32 + payload length
+	journalHeaderSize = 8
+
+	journalEntry byte = 1
+	journalDone  byte = 2
+	journalSeq   byte = 3
+
+	// the journal is rewritten when it has that many records and 4 times more than pending entries
+	journalCompactRecords = 1024
+)
+
+var ErrCorruptJournal = errors.New("corrupt journal record")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Journal of the writes of a process that the entity has not answered yet.
+// Record: crc32(payload) | len(payload) | payload
+// Entry: 1 | uvarint id | string key | op | string data | varint ttl [| uvarint seq]
+// Done: 2 | uvarint id | string key, the entries of the key up to id are answered
+// Seq: 3 | uvarint seq, the highest sequence given out, written on compaction
+// String: uvarint len | bytes
+type journal struct {
+	f    *os.File
+	path string
+	sync bool
+	buf  []byte
+
+	next uint64
+	// the last unanswered entry of every key
+	pending map[string]Entry
+	records int
+	// the highest sequence of the entries ever added
+	maxSeq uint64
+
+	// the records with a bad checksum and the bytes of the torn tail found by load
+	skipped int
+	torn    int64
+}
+
+// openJournal opens or creates the journal at path and returns the unanswered entries in the order they were added.
+// The journal is rewritten with only them
+func openJournal(path string, sync bool) (*journal, []Entry, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	j := &journal{
+		f:       f,
+		path:    path,
+		sync:    sync,
+		next:    1,
+		pending: make(map[string]Entry),
+	}
+	if err := j.load(); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if err := j.compact(); err != nil {
+		j.f.Close()
+		return nil, nil, err
+	}
+	return j, j.entries(), nil
+}
+
+// load reads the pending entries.
+// A torn last record left by a crash is ignored, a bad record with more after it is skipped and counted
+func (j *journal) load() error {
+	st, err := j.f.Stat()
+	if err != nil {
+		return err
+	}
+	var (
+		r      = bufio.NewReader(j.f)
+		offset int64
+	)
+	for {
+		payload, n, err := readJournalRecord(r, st.Size()-offset)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF || err == ErrCorruptJournal && offset+n == st.Size() {
+			j.torn = st.Size() - offset
+			return nil
+		}
+		offset += n
+		if err == ErrCorruptJournal {
+			j.skipped++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		kind, e, err := decodeJournalRecord(payload)
+		if err != nil {
+			return err
+		}
+		if e.seq > j.maxSeq {
+			j.maxSeq = e.seq
+		}
+		if kind == journalSeq {
+			continue
+		}
+		if e.jid >= j.next {
+			j.next = e.jid + 1
+		}
+		switch kind {
+		case journalEntry:
+			j.pending[e.key] = e
+		case journalDone:
+			if old, ok := j.pending[e.key]; ok && old.jid <= e.jid {
+				delete(j.pending, e.key)
+			}
+		}
+	}
+}
+
+// entries returns the pending entries ordered by id
+func (j *journal) entries() []Entry {
+	es := make([]Entry, 0, len(j.pending))
+	for _, e := range j.pending {
+		es = append(es, e)
+	}
+	sort.Slice(es, func(a, b int) bool { return es[a].jid < es[b].jid })
+	return es
+}
+
+// add writes e to the journal and gives it an id
+func (j *journal) add(e *Entry) error {
+	e.jid = j.next
+	j.next++
+	e.key = e.data.Key
+
+	j.buf = appendJournalEntry(j.buf[:0], *e)
+	if err := j.write(); err != nil {
+		return err
+	}
+	j.pending[e.key] = *e
+	if e.seq > j.maxSeq {
+		j.maxSeq = e.seq
+	}
+	return j.maybeCompact()
+}
+
+// done marks the entries of the key up to e as answered
+func (j *journal) done(e Entry) error {
+	old, ok := j.pending[e.data.Key]
+	if e.jid == 0 || !ok || old.jid > e.jid {
+		return nil
+	}
+	delete(j.pending, e.data.Key)
+
+	j.buf = appendJournalDone(j.buf[:0], e.jid, e.data.Key)
+	if err := j.write(); err != nil {
+		return err
+	}
+	return j.maybeCompact()
+}
+
+func (j *journal) write() error {
+	if _, err := j.f.Write(j.buf); err != nil {
+		return err
+	}
+	j.records++
+	if j.sync {
+		return j.f.Sync()
+	}
+	return nil
+}
+
+func (j *journal) maybeCompact() error {
+	if j.records < journalCompactRecords || j.records < 4*len(j.pending) {
+		return nil
+	}
+	return j.compact()
+}
+
+// compact atomically replaces the journal with the pending entries
+func (j *journal) compact() error {
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	entries := j.entries()
+	buf := make([]byte, 0, 64*len(entries)+16)
+	if j.maxSeq > 0 {
+		buf = appendJournalSeq(buf, j.maxSeq)
+	}
+	for _, e := range entries {
+		buf = appendJournalEntry(buf, e)
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		f.Close()
+		return err
+	}
+	if err := syncDir(filepath.Dir(j.path)); err != nil {
+		f.Close()
+		return err
+	}
+
+	j.f.Close()
+	j.f = f
+	j.records = len(entries)
+	return nil
+}
+
+func (j *journal) close() error {
+	if err := j.f.Sync(); err != nil {
+		j.f.Close()
+		return err
+	}
+	return j.f.Close()
+}
+
+func appendJournalEntry(buf []byte, e Entry) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, journalHeaderSize)...)
+	buf = append(buf, journalEntry)
+	buf = binary.AppendUvarint(buf, e.jid)
+	buf = appendString(buf, e.data.Key)
+	buf = append(buf, byte(e.op))
+	buf = appendString(buf, e.data.Data)
+	buf = binary.AppendVarint(buf, int64(e.ttl))
+	buf = binary.AppendUvarint(buf, e.seq)
+	return sealJournalRecord(buf, start)
+}
+
+func appendJournalSeq(buf []byte, seq uint64) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, journalHeaderSize)...)
+	buf = append(buf, journalSeq)
+	buf = binary.AppendUvarint(buf, seq)
+	return sealJournalRecord(buf, start)
+}
+
+func appendJournalDone(buf []byte, jid uint64, key string) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, journalHeaderSize)...)
+	buf = append(buf, journalDone)
+	buf = binary.AppendUvarint(buf, jid)
+	buf = appendString(buf, key)
+	return sealJournalRecord(buf, start)
+}
+
+func sealJournalRecord(buf []byte, start int) []byte {
+	payload := buf[start+journalHeaderSize:]
+	binary.LittleEndian.PutUint32(buf[start:], crc32.Checksum(payload, crcTable))
+	binary.LittleEndian.PutUint32(buf[start+4:], uint32(len(payload)))
+	return buf
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// readJournalRecord reads the next record of the left bytes of the journal and returns its size.
+// io.ErrUnexpectedEOF is returned for a record that runs past them,
+// ErrCorruptJournal with the size for a bad checksum
+func readJournalRecord(r io.Reader, left int64) ([]byte, int64, error) {
+	if left <= 0 {
+		return nil, 0, io.EOF
+	}
+	if left < journalHeaderSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	var header [journalHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	sum := binary.LittleEndian.Uint32(header[0:])
+	size := binary.LittleEndian.Uint32(header[4:])
+	n := journalHeaderSize + int64(size)
+	if n > left {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	if crc32.Checksum(payload, crcTable) != sum || len(payload) == 0 {
+		return nil, n, ErrCorruptJournal
+	}
+	return payload, n, nil
+}
+
+func decodeJournalRecord(payload []byte) (byte, Entry, error) {
+	var (
+		kind = payload[0]
+		rest = payload[1:]
+		e    Entry
+	)
+	if kind == journalSeq {
+		seq, l := binary.Uvarint(rest)
+		if l <= 0 {
+			return 0, Entry{}, ErrCorruptJournal
+		}
+		e.seq = seq
+		return kind, e, nil
+	}
+	jid, l := binary.Uvarint(rest)
+	if l <= 0 {
+		return 0, Entry{}, ErrCorruptJournal
+	}
+	rest = rest[l:]
+	key, rest, err := readString(rest)
+	if err != nil {
+		return 0, Entry{}, err
+	}
+	e.jid, e.key = jid, key
+
+	switch kind {
+	case journalDone:
+		return kind, e, nil
+	case journalEntry:
+	default:
+		return 0, Entry{}, ErrCorruptJournal
+	}
+
+	if len(rest) == 0 {
+		return 0, Entry{}, ErrCorruptJournal
+	}
+	e.op = mes.Op(rest[0])
+	data, rest, err := readString(rest[1:])
+	if err != nil {
+		return 0, Entry{}, err
+	}
+	ttl, l := binary.Varint(rest)
+	if l <= 0 {
+		return 0, Entry{}, ErrCorruptJournal
+	}
+	e.data = mes.NewInside(key, data)
+	e.ttl = time.Duration(ttl)
+	// the records written before the sequences have none
+	if rest = rest[l:]; len(rest) > 0 {
+		seq, l := binary.Uvarint(rest)
+		if l <= 0 {
+			return 0, Entry{}, ErrCorruptJournal
+		}
+		e.seq = seq
+	}
+	return kind, e, nil
+}
+
+func readString(buf []byte) (string, []byte, error) {
+	n, l := binary.Uvarint(buf)
+	if l <= 0 || uint64(len(buf)-l) < n {
+		return "", nil, ErrCorruptJournal
+	}
+	return string(buf[l : l+int(n)]), buf[l+int(n):], nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("sync dir %s: %w", dir, err)
+	}
+	return nil
+}
+
+// openJournal opens the journal on first use and pushes the entries that were not answered
+// before the last shutdown, so they come before the new writes. jk must be held
+func (p *impl) openJournal() error {
+	if p.journal != nil || p.journalPath == "" {
+		return nil
+	}
+	if p.journalClosed {
+		return ErrShutdownProcess
+	}
+	j, entries, err := openJournal(p.journalPath, p.syncJournal)
+	if err != nil {
+		return err
+	}
+	p.journal = j
+	if j.skipped > 0 {
+		p.logger.Warn("journal records skipped", "proc", p.id, "path", p.journalPath, "records", j.skipped)
+	}
+	if j.torn > 0 {
+		p.logger.Warn("journal torn tail ignored", "proc", p.id, "path", p.journalPath, "bytes", j.torn)
+	}
+	// the new sequences go on above the ones the entity may have seen,
+	// also if the clock has gone back since
+	p.raiseSeq(j.maxSeq)
+	for _, e := range entries {
+		// the entity drops a resend it has applied by its sequence
+		if e.seq == 0 {
+			e.seq = p.nextSeq()
+		}
+		p.queue.Push(e)
+	}
+	return nil
+}
+
+// journalAdd gives e the next sequence and writes it to the journal if there is one
+func (p *impl) journalAdd(e *Entry) error {
+	if p.journalPath == "" {
+		e.seq = p.nextSeq()
+		return nil
+	}
+	p.jk.Lock()
+	defer p.jk.Unlock()
+
+	if err := p.openJournal(); err != nil {
+		return err
+	}
+	e.seq = p.nextSeq()
+	return p.journal.add(e)
+}
+
+// journalDone marks e as answered by the entity
+func (p *impl) journalDone(e Entry) {
+	if e.jid == 0 {
+		return
+	}
+	p.jk.Lock()
+	defer p.jk.Unlock()
+
+	if p.journal == nil {
+		return
+	}
+	if err := p.journal.done(e); err != nil {
+		p.logger.Error("journal done", "proc", p.id, "key", e.key, "err", err)
+	}
+}
+
+// replayJournal opens the journal if no write has done it yet
+func (p *impl) replayJournal() error {
+	if p.journalPath == "" {
+		return nil
+	}
+	p.jk.Lock()
+	defer p.jk.Unlock()
+
+	return p.openJournal()
+}
+
+func (p *impl) closeJournal() {
+	p.jk.Lock()
+	defer p.jk.Unlock()
+
+	p.journalClosed = true
+	if p.journal == nil {
+		return
+	}
+	if err := p.journal.close(); err != nil {
+		p.logger.Error("journal close", "proc", p.id, "err", err)
+	}
+	p.journal = nil
+}
@@ -1,64 +1,181 @@
 package process
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
 	"time"
 
+	"github.com/benbjohnson/clock"
 	opts "github.com/qwertyqq2/entity"
 )
 
 type Option func(*impl)
 
+var ErrBadOptions = errors.New("bad options")
+
+// Options of the scheduler of a process, every Option below sets one of them
+type Options struct {
+	// How often the wanted entries are sent even if the batch is not full
+	ResentInterval time.Duration
+	// How long a write waits for its response before it is sent again and the process reconnects
+	WaitRespInterval time.Duration
+	// Delay between the attempts to reconnect
+	ReconnectInterval time.Duration
+	// The process shuts down if it can not reconnect for that long
+	MaxWaitingConnection time.Duration
+	// Size of the data of the entries sent in one Batch message, 0 sends one entry per message
+	MaxMsgSize int
+	// The wanted entries are sent right away once there are more of them
+	SendMsgCutoff int
+	// How long an added entry may wait for the batch to fill up, 0 sends it right away
+	SendMessageMaxDelay time.Duration
+	// Writes sent to the entity without their responses
+	MaxInFlight int
+}
+
+func DefaultOptions() Options {
+	return Options{
+		ResentInterval:       opts.ResentInterval,
+		WaitRespInterval:     opts.WaitSendInterval,
+		ReconnectInterval:    opts.ReconnectInterval,
+		MaxWaitingConnection: opts.MaxWaitingConnection,
+		MaxMsgSize:           opts.MaxMsgSize,
+		SendMsgCutoff:        opts.SendMsgCutoff,
+		SendMessageMaxDelay:  opts.SendMessageMaxDelay,
+		MaxInFlight:          opts.MaxInFlight,
+	}
+}
+
+// Validate returns an error wrapping ErrBadOptions for the first bad value
+func (o Options) Validate() error {
+	switch {
+	case o.ResentInterval <= 0:
+		return fmt.Errorf("%w: ResentInterval must be positive", ErrBadOptions)
+	case o.WaitRespInterval <= 0:
+		return fmt.Errorf("%w: WaitRespInterval must be positive", ErrBadOptions)
+	case o.ReconnectInterval <= 0:
+		return fmt.Errorf("%w: ReconnectInterval must be positive", ErrBadOptions)
+	case o.MaxWaitingConnection < o.ReconnectInterval:
+		return fmt.Errorf("%w: MaxWaitingConnection must not be less than ReconnectInterval", ErrBadOptions)
+	case o.MaxMsgSize < 0:
+		return fmt.Errorf("%w: MaxMsgSize must not be negative", ErrBadOptions)
+	case o.SendMsgCutoff < 0:
+		return fmt.Errorf("%w: SendMsgCutoff must not be negative", ErrBadOptions)
+	case o.SendMessageMaxDelay < 0:
+		return fmt.Errorf("%w: SendMessageMaxDelay must not be negative", ErrBadOptions)
+	case o.MaxInFlight < 1:
+		return fmt.Errorf("%w: MaxInFlight must be at least 1", ErrBadOptions)
+	}
+	return nil
+}
+
+// WithOptions sets all options, Start returns the error of Validate
+func WithOptions(o Options) Option {
+	return func(i *impl) {
+		i.cfg = o
+	}
+}
+
 func ResentInterval(resentInterval time.Duration) Option {
 	return func(i *impl) {
-		i.resendInterval = resentInterval
+		i.cfg.ResentInterval = resentInterval
 	}
 }
 
 func WaitRespInterval(waitRespInterval time.Duration) Option {
 	return func(i *impl) {
-		i.waitRespInterval = waitRespInterval
+		i.cfg.WaitRespInterval = waitRespInterval
 	}
 }
 
 func ReconnectInterval(reconnectInterval time.Duration) Option {
 	return func(i *impl) {
-		i.reconnectInterval = reconnectInterval
+		i.cfg.ReconnectInterval = reconnectInterval
 	}
 }
 
+// MaxMsgSize of the data of the entries sent in one Batch message, 0 sends one entry per message
 func MaxMsgSize(msgSize int) Option {
 	return func(i *impl) {
-		i.maxMsgSize = msgSize
+		i.cfg.MaxMsgSize = msgSize
+	}
+}
+
+// MaxInFlight writes sent to the entity without their responses.
+// More than one lets the process send the next batch before the last one is answered
+func MaxInFlight(n int) Option {
+	return func(i *impl) {
+		i.cfg.MaxInFlight = n
 	}
 }
 
 func MaxWaitingConnection(maxWaitingConnection time.Duration) Option {
 	return func(i *impl) {
-		i.maxWaitingConnection = maxWaitingConnection
+		i.cfg.MaxWaitingConnection = maxWaitingConnection
 	}
 }
 
 func SendMessageMaxDelay(sendMessageMaxDelay time.Duration) Option {
 	return func(i *impl) {
-		i.sendMessageMaxDelay = sendMessageMaxDelay
+		i.cfg.SendMessageMaxDelay = sendMessageMaxDelay
 	}
 }
 
 func SendMsgCutoff(sendMsgCutoff int) Option {
 	return func(i *impl) {
-		i.sendMsgCutoff = sendMsgCutoff
+		i.cfg.SendMsgCutoff = sendMsgCutoff
+	}
+}
+
+// Clock used for the timers of the process and to seed the sequences of its writes,
+// the real clock by default
+func WithClock(c clock.Clock) Option {
+	return func(i *impl) {
+		i.clock = c
+		i.seedSeq()
+	}
+}
+
+// Logger for reconnects, failed writes, journal errors and every message at debug level.
+// Silent by default
+func WithLogger(l *slog.Logger) Option {
+	return func(i *impl) {
+		i.logger = l
+	}
+}
+
+// discardLogger is enabled for no level, so the records are not even built
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.Level(math.MaxInt)}))
+}
+
+// OnFailed is called with every entry the entity answers with Fail.
+// The entry stays in DeadLetters until RetryDeadLetters
+func OnFailed(fn func(e Entry, err error)) Option {
+	return func(i *impl) {
+		i.onFailed = fn
+	}
+}
+
+// Journal keeps the writes that the entity has not answered in the file at path.
+// They are sent again by Start after a restart of the process
+func Journal(path string) Option {
+	return func(i *impl) {
+		i.journalPath = path
+	}
+}
+
+// SyncJournal makes every write to the journal fsynced, so the writes survive a crash of the machine
+func SyncJournal(sync bool) Option {
+	return func(i *impl) {
+		i.syncJournal = sync
 	}
 }
 
 // is better
 func DefaultOpts() []Option {
-	return []Option{
-		ResentInterval(opts.ResentInterval),
-		WaitRespInterval(opts.WaitSendInterval),
-		ReconnectInterval(opts.ReconnectInterval),
-		MaxWaitingConnection(opts.MaxWaitingConnection),
-		MaxMsgSize(opts.MaxMsgSize),
-		SendMessageMaxDelay(opts.SendMessageMaxDelay),
-		SendMsgCutoff(opts.SendMsgCutoff),
-	}
+	return []Option{WithOptions(DefaultOptions())}
 }
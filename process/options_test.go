@@ -0,0 +1,319 @@
+package process
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/qwertyqq2/entity/entity"
+	mes "github.com/qwertyqq2/entity/message"
+)
+
+// quiet options that send only on Flush
+func quietOptions() Options {
+	o := DefaultOptions()
+	o.ResentInterval = time.Hour
+	o.SendMessageMaxDelay = time.Hour
+	o.SendMsgCutoff = 1000
+	o.MaxMsgSize = 1 << 20
+	return o
+}
+
+// startCounted starts a process with o over a new entity and counts its messages
+func startCounted(t *testing.T, o Options) (*impl, *countTransport, entity.Entity) {
+	ent := entity.New(procLimit)
+	tr := &countTransport{Transport: ent}
+	proc := newProc(1)
+	WithOptions(o)(proc)
+	if err := proc.Start(tr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		proc.Shutdown()
+		ent.Shutdown()
+	})
+	return proc, tr, ent
+}
+
+// waitFor waits until ok, the goroutines of the process run on the real time
+// even if its timers are on a mock clock
+func waitFor(t *testing.T, ok func() bool, args ...interface{}) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatal(args...)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitLen waits until the entity has n keys
+func waitLen(t *testing.T, ent entity.Entity, n int) {
+	waitFor(t, func() bool { return ent.Len() == n }, "wrong len", n)
+}
+
+// startMock starts a process with o on a mock clock
+func startMock(t *testing.T, o Options, tr Transport) (*impl, *clock.Mock) {
+	mock := clock.NewMock()
+	proc := newProc(1)
+	WithOptions(o)(proc)
+	WithClock(mock)(proc)
+	if err := proc.Start(tr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(proc.Shutdown)
+	return proc, mock
+}
+
+func addKeys(proc *impl, from, to int) {
+	for i := from; i < to; i++ {
+		proc.Add(fmt.Sprintf("k%d", i), "is k")
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	if err := DefaultOptions().Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := []func(o *Options){
+		func(o *Options) { o.ResentInterval = 0 },
+		func(o *Options) { o.WaitRespInterval = -time.Second },
+		func(o *Options) { o.ReconnectInterval = 0 },
+		func(o *Options) { o.MaxWaitingConnection = o.ReconnectInterval / 2 },
+		func(o *Options) { o.MaxMsgSize = -1 },
+		func(o *Options) { o.SendMsgCutoff = -1 },
+		func(o *Options) { o.SendMessageMaxDelay = -time.Second },
+		func(o *Options) { o.MaxInFlight = 0 },
+	}
+	for i, fn := range bad {
+		o := DefaultOptions()
+		fn(&o)
+		if err := o.Validate(); !errors.Is(err, ErrBadOptions) {
+			t.Fatal("expected bad options", i, err)
+		}
+	}
+
+	ent := entity.New(procLimit)
+	defer ent.Shutdown()
+	if _, err := WithEntity(1, ent, MaxInFlight(0)); !errors.Is(err, ErrBadOptions) {
+		t.Fatal("expected bad options", err)
+	}
+}
+
+func TestOptionSendMsgCutoff(t *testing.T) {
+	o := quietOptions()
+	o.SendMsgCutoff = 5
+	proc, tr, ent := startCounted(t, o)
+
+	addKeys(proc, 0, 5)
+	time.Sleep(200 * time.Millisecond)
+	if n := tr.msgs.Load(); n != 0 {
+		t.Fatal("sent before the cutoff", n)
+	}
+
+	addKeys(proc, 5, 6)
+	waitLen(t, ent, 6)
+}
+
+func TestOptionSendMessageMaxDelay(t *testing.T) {
+	proc, tr, _ := startCounted(t, quietOptions())
+	addKeys(proc, 0, 1)
+	time.Sleep(200 * time.Millisecond)
+	if n := tr.msgs.Load(); n != 0 {
+		t.Fatal("sent before the delay", n)
+	}
+
+	o := quietOptions()
+	o.SendMessageMaxDelay = 50 * time.Millisecond
+	proc, _, ent := startCounted(t, o)
+	addKeys(proc, 0, 1)
+	waitLen(t, ent, 1)
+}
+
+func TestOptionResentInterval(t *testing.T) {
+	ent := entity.New(procLimit)
+	defer ent.Shutdown()
+	o := quietOptions()
+	o.ResentInterval = time.Second
+	proc, mock := startMock(t, o, ent)
+
+	addKeys(proc, 0, 3)
+	waitFor(t, func() bool { return proc.Stats().Pending == 3 }, "not queued")
+	mock.Add(time.Second - time.Millisecond)
+	if ent.Len() != 0 {
+		t.Fatal("sent before the interval", ent.Len())
+	}
+	mock.Add(time.Millisecond)
+	waitLen(t, ent, 3)
+}
+
+func TestOptionMaxMsgSize(t *testing.T) {
+	for _, c := range []struct {
+		size int
+		msgs int64
+	}{
+		{size: 0, msgs: 10},
+		{size: 1 << 10, msgs: 1},
+	} {
+		o := quietOptions()
+		o.MaxMsgSize = c.size
+		proc, tr, ent := startCounted(t, o)
+
+		addKeys(proc, 0, 10)
+		if err := proc.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if ent.Len() != 10 {
+			t.Fatal("wrong len", ent.Len())
+		}
+		if n := tr.msgs.Load(); n != c.msgs {
+			t.Fatal("wrong messages", c.size, n)
+		}
+
+		// deletes have no data and are packed the same
+		for i := 0; i < 10; i++ {
+			proc.Delete(fmt.Sprintf("k%d", i))
+		}
+		if err := proc.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if ent.Len() != 0 {
+			t.Fatal("wrong len", ent.Len())
+		}
+		if n := tr.msgs.Load(); n != 2*c.msgs {
+			t.Fatal("wrong messages of deletes", c.size, n)
+		}
+	}
+}
+
+func TestOptionWaitRespInterval(t *testing.T) {
+	o := DefaultOptions()
+	o.SendMsgCutoff = 0
+	o.WaitRespInterval = time.Second
+	o.ResentInterval = time.Hour
+	proc, mock := startMock(t, o, silentTransport{})
+
+	proc.Add("k1", "is k1")
+	waitFor(t, func() bool { return proc.Stats().InFlight == 1 }, "not sent")
+	mock.Add(time.Second - time.Millisecond)
+	if s := proc.Stats(); s.Resent != 0 {
+		t.Fatal("resent before the interval", s)
+	}
+	mock.Add(time.Millisecond)
+	waitFor(t, func() bool { return proc.Stats().Resent == 1 }, "not resent")
+}
+
+// transport that never answers and refuses to connect after the first time
+type refuseTransport struct {
+	silentTransport
+	connects atomic.Int64
+}
+
+func (t *refuseTransport) Connect(id int) (chan<- mes.Message, error) {
+	if t.connects.Add(1) > 1 {
+		return nil, errors.New("refused")
+	}
+	return t.silentTransport.Connect(id)
+}
+
+func TestOptionReconnect(t *testing.T) {
+	for _, c := range []struct {
+		interval time.Duration
+		connects int64
+	}{
+		{interval: time.Second, connects: 11},
+		{interval: 5 * time.Second, connects: 3},
+	} {
+		o := DefaultOptions()
+		o.SendMsgCutoff = 0
+		o.WaitRespInterval = time.Second
+		o.ResentInterval = time.Hour
+		o.ReconnectInterval = c.interval
+		o.MaxWaitingConnection = 10 * time.Second
+		tr := &refuseTransport{}
+		proc, mock := startMock(t, o, tr)
+
+		proc.Add("k1", "is k1")
+		waitFor(t, func() bool { return proc.Stats().InFlight == 1 }, "not sent")
+		mock.Add(o.WaitRespInterval)
+		waitFor(t, func() bool { return tr.connects.Load() == 2 }, "no reconnect")
+
+		// the process gives up after MaxWaitingConnection
+		for i := 0; proc.ctx.Err() == nil; i++ {
+			if i > 100 {
+				t.Fatal("process is not shut down")
+			}
+			n := tr.connects.Load()
+			mock.Add(c.interval)
+			waitFor(t, func() bool { return tr.connects.Load() > n || proc.ctx.Err() != nil }, "no reconnect")
+		}
+		if n := tr.connects.Load(); n != c.connects {
+			t.Fatal("wrong connects", c.interval, n)
+		}
+	}
+}
+
+// buffer the logger writes to while the test reads it
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestOptionLogger(t *testing.T) {
+	if newProc(1).logger.Enabled(context.Background(), slog.LevelError) {
+		t.Fatal("logger is not silent by default")
+	}
+
+	var out logBuffer
+	ent := entity.New(procLimit)
+	defer ent.Shutdown()
+	proc := newProc(1)
+	WithLogger(slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug})))(proc)
+	if err := proc.Start(ent); err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Shutdown()
+
+	proc.Add("k1", "is k1")
+	if err := proc.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return strings.Contains(out.String(), `"msg":"response"`) }, "no response record", out.String())
+	for _, field := range []string{`"msg":"send"`, `"proc":1`, `"op":"add"`, `"latency":`} {
+		if !strings.Contains(out.String(), field) {
+			t.Fatal("no field", field, out.String())
+		}
+	}
+}
+
+func TestOptionClockSeq(t *testing.T) {
+	mock := clock.NewMock()
+	mock.Add(time.Hour)
+
+	proc := newProc(1)
+	WithClock(mock)(proc)
+	if seq := proc.nextSeq(); seq != uint64(mock.Now().UnixNano())+1 {
+		t.Fatal("sequence is not seeded from the clock", seq)
+	}
+}
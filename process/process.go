@@ -1,11 +1,29 @@
 package process
 
 import (
+	"context"
+	"time"
+
 	"github.com/qwertyqq2/entity/entity"
+	mes "github.com/qwertyqq2/entity/message"
 )
 
 type Entity = entity.Entity
 
+// Connection of processes to an entity.
+// An Entity is a Transport itself, DialTCP reaches one served over the network
+type Transport interface {
+	// Opens the session of the process, the messages are sent to the returned channel
+	Connect(id int) (chan<- mes.Message, error)
+
+	// Closes the session of the process
+	Disconnect(id int) error
+
+	// Waits for the next response to the process, a nil message means no response in time.
+	// A response carries the request id of its message, the process matches them by it
+	Resp(id int) mes.Message
+}
+
 // A function that is executed during the lifetime of a process
 type ProcessFunc func(proc Process)
 
@@ -14,24 +32,91 @@ type Process interface {
 	//Closing a process
 	Shutdown()
 
+	// Sends everything added so far and waits until the entity has answered it
+	Flush(ctx context.Context) error
+
+	// Flushes the process, disconnects it from the entity and shuts it down.
+	// The process is shut down even if ctx is done first
+	Close(ctx context.Context) error
+
 	// Registration entity for process
 	// Returns an error if the process is already registered or if the entity is closed
-	Registration(ent entity.Entity) error
+	Registration(ent Transport) error
 
 	//Adds data to the process, after which they will go to the entity
 	Add(key, data string)
 
+	// Adds data that the entity drops after ttl
+	AddWithTTL(key, data string, ttl time.Duration)
+
 	//Creates a request to remove data from an entity
 	Delete(key string)
 
+	// Adds data like Add and returns the ack of the write.
+	// If ctx is done before the write is sent it is dropped, after that it may still be applied
+	AddCtx(ctx context.Context, key, data string) (Ack, error)
+
+	// Removes the key like Delete and returns the ack of the write
+	DeleteCtx(ctx context.Context, key string) (Ack, error)
+
+	// Reads the data stored in the entity by key
+	// Returns ErrNotFound if there is no such key
+	Get(key string) (mes.Inside, error)
+
+	// Checks if the entity stores the key
+	Has(key string) (bool, error)
+
+	// Writes data only if the key has the expected version, 0 means the key must not exist.
+	// Returns the new version or ErrVersionMismatch
+	CompareAndSwap(key string, expectedVersion uint64, data string) (uint64, error)
+
+	// Applies the operations collected by fn all together or not at all.
+	// They are sent right away and are not ordered with the queued Add and Delete
+	Txn(fn func(tx Tx)) error
+
 	//Start a process
-	Start(ent entity.Entity) error
+	Start(ent Transport) error
+
+	// Counters and queue depth of the process
+	Stats() Stats
+
+	// Options the process runs with
+	Options() Options
+
+	// Swaps the options of a running process without dropping queued or sent entries.
+	// Returns ErrBadOptions for a bad value and ErrShutdownProcess after Shutdown
+	Reconfigure(o Options) error
+
+	// Entries the entity answered with Fail, the last one of every key
+	DeadLetters() []Entry
+
+	// Sends the dead letters again unless the key has a newer write, returns their number
+	RetryDeadLetters() int
 
 	//Process id
 	ID() int
 }
 
-func WithProcessFunc(num int, fn ProcessFunc, ent Entity, opts ...Option) (Process, error) {
+// Counters of a process since it was created
+type Stats struct {
+	// Messages written to the entity
+	Sent uint64
+	// Messages the entity answered with Success
+	Acked uint64
+	// Messages the entity answered with Fail
+	Failed uint64
+	// Entries put back to be sent again after a timeout or a resend interval
+	Resent uint64
+
+	// Entries in the queue of the process
+	Queued int
+	// Entries waiting to be sent
+	Pending int
+	// Entries sent and not answered yet
+	InFlight int
+}
+
+func WithProcessFunc(num int, fn ProcessFunc, ent Transport, opts ...Option) (Process, error) {
 	proc := newProc(num)
 
 	for _, o := range opts {
@@ -50,7 +135,7 @@ func WithProcessFunc(num int, fn ProcessFunc, ent Entity, opts ...Option) (Proce
 	return proc, nil
 }
 
-func WithEntity(num int, ent Entity, opts ...Option) (Process, error) {
+func WithEntity(num int, ent Transport, opts ...Option) (Process, error) {
 	proc := newProc(num)
 
 	for _, o := range opts {
@@ -2,10 +2,16 @@ package process
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/benbjohnson/clock"
 	"github.com/qwertyqq2/entity/entity"
 	mes "github.com/qwertyqq2/entity/message"
 )
@@ -135,6 +141,14 @@ func TestQueueIncomig(t *testing.T) {
 }
 
 // uploading data to a process
+// sendAll sends the entries and waits for the responses of the entity
+func sendAll(proc *impl) {
+	for !proc.drained() {
+		proc.sendIfReady()
+		time.Sleep(time.Millisecond)
+	}
+}
+
 func unloading(proc *impl) {
 	after := time.After(durationWrite)
 	go proc.queueIncomig()
@@ -188,6 +202,165 @@ func TestSendOnce(t *testing.T) {
 	fmt.Println(proc.recall.String())
 }
 
+func TestGetHas(t *testing.T) {
+	proc := newProc(1)
+	go proc.queueIncomig()
+	defer proc.Shutdown()
+
+	ent := entity.New(procLimit)
+	if err := proc.Registration(ent); err != nil {
+		t.Fatal(err)
+	}
+
+	proc.Add("snap", "is a snap")
+	time.Sleep(100 * time.Millisecond)
+	proc.sendIfReady()
+
+	in, err := proc.Get("snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Data != "is a snap" {
+		t.Fatal("wrong data", in.Data)
+	}
+
+	ok, err := proc.Has("snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("key must exist")
+	}
+
+	if _, err := proc.Get("snap2"); err != ErrNotFound {
+		t.Fatal("expected not found", err)
+	}
+
+	ok, err = proc.Has("snap2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("key must not exist")
+	}
+}
+
+func TestRequestReconnect(t *testing.T) {
+	ent := entity.New(procLimit, entity.IdleTimeout(100*time.Millisecond))
+	defer ent.Shutdown()
+	proc, err := WithEntity(1, ent, WaitRespInterval(200*time.Millisecond), ReconnectInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Shutdown()
+
+	proc.Add("snap", "is a snap")
+	if err := proc.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// the entity closes the idle session, a request without response reconnects
+	time.Sleep(300 * time.Millisecond)
+	waitFor(t, func() bool {
+		in, err := proc.Get("snap")
+		return err == nil && in.Data == "is a snap"
+	}, "no reconnect after a request timeout")
+}
+
+func TestAddWithTTL(t *testing.T) {
+	proc := newProc(1)
+	go proc.queueIncomig()
+	defer proc.Shutdown()
+
+	mock := clock.NewMock()
+	ent := entity.New(procLimit, entity.WithClock(mock))
+	if err := proc.Registration(ent); err != nil {
+		t.Fatal(err)
+	}
+
+	proc.AddWithTTL("snap", "is a snap", time.Second)
+	time.Sleep(100 * time.Millisecond)
+	proc.sendIfReady()
+
+	in, err := proc.Get("snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.ExpiresAt.IsZero() {
+		t.Fatal("no deadline")
+	}
+
+	mock.Add(time.Second)
+	if _, err := proc.Get("snap"); err != ErrNotFound {
+		t.Fatal("key must expire", err)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	proc := newProc(1)
+	go proc.queueIncomig()
+	defer proc.Shutdown()
+
+	ent := entity.New(procLimit)
+	if err := proc.Registration(ent); err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := proc.CompareAndSwap("snap", 0, "is a snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := proc.CompareAndSwap("snap", 0, "is a snap again"); err != ErrVersionMismatch {
+		t.Fatal("expected version mismatch", err)
+	}
+
+	if _, err := proc.CompareAndSwap("snap", version, "is a snap again"); err != nil {
+		t.Fatal(err)
+	}
+
+	in, err := proc.Get("snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Data != "is a snap again" || in.Version != version+1 {
+		t.Fatal("wrong value", in)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	proc := newProc(1)
+	go proc.queueIncomig()
+	defer proc.Shutdown()
+
+	ent := entity.New(procLimit)
+	if err := proc.Registration(ent); err != nil {
+		t.Fatal(err)
+	}
+
+	err := proc.Txn(func(tx Tx) {
+		tx.Add("k1", "v1")
+		tx.Add("k2", "v2")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = proc.Txn(func(tx Tx) {
+		tx.Delete("k1")
+		tx.CompareAndSwap("k2", 0, "stale")
+	})
+	if err != ErrVersionMismatch {
+		t.Fatal("expected version mismatch", err)
+	}
+
+	if ok, err := proc.Has("k1"); err != nil || !ok {
+		t.Fatal("failed txn is applied", err)
+	}
+	if ent.Len() != 2 {
+		t.Fatal("wrong len", ent.Len())
+	}
+}
+
 func TestSend(t *testing.T) {
 	proc := newProc(1)
 	unloading(proc)
@@ -198,9 +371,7 @@ func TestSend(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	for proc.hasPendingWork() {
-		proc.sendIfReady()
-	}
+	sendAll(proc)
 
 	fmt.Println(ent.String())
 }
@@ -215,9 +386,7 @@ func TestSendTimeout(t *testing.T) {
 	if err := proc.Registration(ent); err != nil {
 		t.Fatal(err)
 	}
-	for proc.hasPendingWork() {
-		proc.sendIfReady()
-	}
+	sendAll(proc)
 
 	len := ent.Len()
 
@@ -287,3 +456,908 @@ func distribution(processes ...*impl) []chan struct{} {
 	}
 	return breaks
 }
+
+func TestStats(t *testing.T) {
+	proc := newProc(1)
+	go proc.queueIncomig()
+	defer proc.Shutdown()
+
+	ent := entity.New(procLimit)
+	if err := proc.Registration(ent); err != nil {
+		t.Fatal(err)
+	}
+	proc.Add("k1", "is k1")
+	proc.Add("k2", "is k2")
+	time.Sleep(100 * time.Millisecond)
+
+	if s := proc.Stats(); s.Pending != 2 || s.Queued != 0 {
+		t.Fatal("wrong depth", s)
+	}
+	sendAll(proc)
+	s := proc.Stats()
+	if s.Sent != 2 || s.Acked != 2 || s.Pending != 0 || s.InFlight != 0 {
+		t.Fatal("wrong stats", s)
+	}
+}
+
+func TestAddCtx(t *testing.T) {
+	proc := newProc(1)
+	go proc.queueIncomig()
+	defer proc.Shutdown()
+
+	ent := entity.New(procLimit)
+	if err := proc.Registration(ent); err != nil {
+		t.Fatal(err)
+	}
+	ack, err := proc.AddCtx(context.Background(), "k1", "is k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the later write of the key takes the place of the unsent one
+	ack2, err := proc.AddCtx(context.Background(), "k1", "new k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if ack.Err() != nil {
+		t.Fatal("ack is resolved before send", ack.Err())
+	}
+
+	sendAll(proc)
+	if err := ack.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ack2.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if in, err := proc.Get("k1"); err != nil || in.Data != "new k1" {
+		t.Fatal("wrong value", in, err)
+	}
+
+	del, err := proc.DeleteCtx(context.Background(), "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	sendAll(proc)
+	if err := del.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := proc.Has("k1"); ok {
+		t.Fatal("k1 must be deleted")
+	}
+}
+
+func TestAddCtxCanceled(t *testing.T) {
+	proc := newProc(1)
+	go proc.queueIncomig()
+
+	ent := entity.New(procLimit)
+	if err := proc.Registration(ent); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ack, err := proc.AddCtx(ctx, "k1", "is k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := ack.Wait(); err != context.Canceled {
+		t.Fatal("expected canceled", err)
+	}
+	if _, err := proc.AddCtx(ctx, "k2", "is k2"); err != context.Canceled {
+		t.Fatal("expected canceled", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	sendAll(proc)
+	if ent.Len() != 0 {
+		t.Fatal("canceled write is sent", ent.String())
+	}
+
+	ack, err = proc.AddCtx(context.Background(), "k3", "is k3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc.Shutdown()
+	if err := ack.Wait(); err != ErrShutdownProcess {
+		t.Fatal("expected shutdown", err)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	ent := entity.New(procLimit)
+	proc := newProc(1)
+	if err := proc.Start(ent); err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Shutdown()
+
+	for i := 0; i < 20; i++ {
+		proc.Add(fmt.Sprintf("k%d", i), "data")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := proc.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ent.Len() != 20 {
+		t.Fatal("wrong len after flush", ent.Len())
+	}
+	if s := proc.Stats(); s.Queued != 0 || s.Pending != 0 || s.InFlight != 0 {
+		t.Fatal("process is not drained", s)
+	}
+}
+
+func TestFlushMockClock(t *testing.T) {
+	ent := entity.New(procLimit)
+	defer ent.Shutdown()
+	// the mock is never moved, Flush does not wait on it
+	proc, _ := startMock(t, DefaultOptions(), ent)
+
+	addKeys(proc, 0, 20)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := proc.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ent.Len() != 20 {
+		t.Fatal("wrong len after flush", ent.Len())
+	}
+	proc.Add("k1", "new k1")
+	if err := proc.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlushTimeout(t *testing.T) {
+	ent := entity.New(procLimit)
+	proc := newProc(1)
+	go proc.queueIncomig()
+	defer proc.Shutdown()
+	if err := proc.Registration(ent); err != nil {
+		t.Fatal(err)
+	}
+
+	// nobody runs the sends
+	proc.Add("k1", "is k1")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := proc.Flush(ctx); err != context.DeadlineExceeded {
+		t.Fatal("expected deadline", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	ent := entity.New(procLimit)
+	proc := newProc(1)
+	if err := proc.Start(ent); err != nil {
+		t.Fatal(err)
+	}
+
+	proc.Add("k1", "is k1")
+	proc.Delete("k2")
+	if err := proc.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ent.Len() != 1 {
+		t.Fatal("wrong len after close", ent.Len())
+	}
+	// the session is closed
+	if _, err := ent.Connect(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := proc.Flush(context.Background()); err != ErrShutdownProcess {
+		t.Fatal("expected shutdown", err)
+	}
+}
+
+// transport that answers Fail while fail is set and records the keys it has applied
+type failTransport struct {
+	fail    atomic.Bool
+	lk      sync.Mutex
+	applied []string
+	resp    chan mes.Message
+}
+
+func (t *failTransport) Connect(id int) (chan<- mes.Message, error) {
+	ch := make(chan mes.Message, 100)
+	t.resp = make(chan mes.Message, 100)
+	go func() {
+		for m := range ch {
+			if m.Op != mes.Batch {
+				t.resp <- t.apply(m).WithID(m.ID)
+				continue
+			}
+			resp := mes.SuccessMessage()
+			for _, op := range m.Ops {
+				resp.Ops = append(resp.Ops, t.apply(op))
+			}
+			t.resp <- resp.WithID(m.ID)
+		}
+	}()
+	return ch, nil
+}
+
+func (t *failTransport) apply(m mes.Message) mes.Message {
+	if t.fail.Load() {
+		return mes.FailMessage(ErrVersionMismatch)
+	}
+	t.lk.Lock()
+	t.applied = append(t.applied, m.Inside.Key)
+	t.lk.Unlock()
+	return mes.SuccessMessage()
+}
+
+func (t *failTransport) Disconnect(id int) error {
+	return nil
+}
+
+func (t *failTransport) Resp(id int) mes.Message {
+	select {
+	case m := <-t.resp:
+		return m
+	case <-time.After(time.Second):
+		return mes.Message{}
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	tr := &failTransport{}
+	tr.fail.Store(true)
+
+	var (
+		lk     sync.Mutex
+		failed []Entry
+	)
+	proc := newProc(1)
+	OnFailed(func(e Entry, err error) {
+		lk.Lock()
+		failed = append(failed, e)
+		lk.Unlock()
+	})(proc)
+	if err := proc.Start(tr); err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Shutdown()
+
+	proc.Add("k1", "is k1")
+	proc.Delete("k2")
+	if err := proc.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	lk.Lock()
+	if len(failed) != 2 {
+		t.Fatal("wrong failed", failed)
+	}
+	lk.Unlock()
+	dead := proc.DeadLetters()
+	if len(dead) != 2 {
+		t.Fatal("wrong dead letters", dead)
+	}
+	for _, e := range dead {
+		if e.Err() != ErrVersionMismatch {
+			t.Fatal("wrong error", e)
+		}
+		if e.Key() == "k2" && e.Op() != mes.Delete {
+			t.Fatal("wrong op", e)
+		}
+	}
+
+	tr.fail.Store(false)
+	if n := proc.RetryDeadLetters(); n != 2 {
+		t.Fatal("wrong retried", n)
+	}
+	if err := proc.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(proc.DeadLetters()) != 0 {
+		t.Fatal("dead letters are left", proc.DeadLetters())
+	}
+	tr.lk.Lock()
+	defer tr.lk.Unlock()
+	if len(tr.applied) != 2 {
+		t.Fatal("wrong applied", tr.applied)
+	}
+}
+
+// transport that reads the writes and never answers them
+type silentTransport struct{}
+
+func (silentTransport) Connect(id int) (chan<- mes.Message, error) {
+	ch := make(chan mes.Message)
+	go func() {
+		for range ch {
+		}
+	}()
+	return ch, nil
+}
+
+func (silentTransport) Disconnect(id int) error {
+	return nil
+}
+
+func (silentTransport) Resp(id int) mes.Message {
+	time.Sleep(100 * time.Millisecond)
+	return mes.Message{}
+}
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+
+	// the writes are not answered before the process goes down
+	proc := newProc(1)
+	Journal(path)(proc)
+	if err := proc.Start(silentTransport{}); err != nil {
+		t.Fatal(err)
+	}
+	proc.Add("k1", "old k1")
+	proc.Add("k2", "is k2")
+	proc.Delete("k3")
+	proc.Add("k1", "is k1")
+	time.Sleep(200 * time.Millisecond)
+	proc.Shutdown()
+
+	ent := entity.New(procLimit)
+	defer ent.Shutdown()
+
+	proc = newProc(1)
+	Journal(path)(proc)
+	if err := proc.Start(ent); err != nil {
+		t.Fatal(err)
+	}
+	if err := proc.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ent.Len() != 2 {
+		t.Fatal("wrong len", ent.Len())
+	}
+	if in, err := proc.Get("k1"); err != nil || in.Data != "is k1" {
+		t.Fatal("wrong k1", in, err)
+	}
+	if err := proc.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is left to resend
+	j, entries, err := openJournal(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+	if len(entries) != 0 {
+		t.Fatal("entries are left", entries)
+	}
+}
+
+func TestJournalRewrite(t *testing.T) {
+	ent := entity.New(procLimit)
+	defer ent.Shutdown()
+
+	proc := newProc(1)
+	Journal(filepath.Join(t.TempDir(), "journal"))(proc)
+	// the journaled entries have their key, the newer write of k1 must not be dropped
+	proc.Add("k1", "old k1")
+	proc.Add("k1", "is k1")
+	if err := proc.Start(ent); err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Shutdown()
+	if err := proc.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if in, err := proc.Get("k1"); err != nil || in.Data != "is k1" {
+		t.Fatal("wrong k1", in, err)
+	}
+}
+
+func TestJournalTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, _, err := openJournal(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys {
+		e := Entry{op: mes.Add, data: mes.NewInside(key, datas[i])}
+		if err := j.add(&e); err != nil {
+			t.Fatal(err)
+		}
+		if key == "k2" {
+			if err := j.done(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// a crash in the middle of a record
+	e := Entry{op: mes.Add, data: mes.NewInside("k5", "is k5")}
+	buf := appendJournalEntry(nil, e)
+	if _, err := j.f.Write(buf[:len(buf)-2]); err != nil {
+		t.Fatal(err)
+	}
+	j.close()
+
+	j, entries, err := openJournal(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+	if len(entries) != 3 {
+		t.Fatal("wrong entries", entries)
+	}
+	for i, key := range []string{"k1", "k3", "k4"} {
+		if entries[i].Key() != key || entries[i].op != mes.Add {
+			t.Fatal("wrong entry", i, entries[i])
+		}
+	}
+	if entries[2].Data() != datas[3] {
+		t.Fatal("wrong data", entries[2])
+	}
+}
+
+func TestJournalCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, _, err := openJournal(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offsets []int64
+	for i, key := range keys {
+		st, err := j.f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, st.Size())
+		e := Entry{op: mes.Add, data: mes.NewInside(key, datas[i])}
+		if err := j.add(&e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a header with a size past the end of the journal
+	header := make([]byte, journalHeaderSize)
+	binary.LittleEndian.PutUint32(header[4:], 1<<31)
+	if _, err := j.f.Write(header); err != nil {
+		t.Fatal(err)
+	}
+	j.close()
+
+	// damage the record of k2 in the middle
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[offsets[1]+journalHeaderSize+2] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	j, entries, err := openJournal(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+	if j.skipped != 1 || j.torn != journalHeaderSize {
+		t.Fatal("wrong skipped", j.skipped, j.torn)
+	}
+	if len(entries) != 3 {
+		t.Fatal("wrong entries", entries)
+	}
+	for i, key := range []string{"k1", "k3", "k4"} {
+		if entries[i].Key() != key {
+			t.Fatal("wrong entry", i, entries[i])
+		}
+	}
+}
+
+func TestJournalSeq(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+
+	// the clock of every start is behind the one before
+	open := func() *impl {
+		proc := newProc(1)
+		WithClock(clock.NewMock())(proc)
+		Journal(path)(proc)
+		if err := proc.replayJournal(); err != nil {
+			t.Fatal(err)
+		}
+		return proc
+	}
+
+	proc := newProc(1)
+	Journal(path)(proc)
+	if err := proc.enqueue(Entry{op: mes.Add, data: mes.NewInside("k1", "is k1")}); err != nil {
+		t.Fatal(err)
+	}
+	seq := proc.queue.pull().seq
+	proc.closeJournal()
+
+	// the replayed entry keeps its sequence, the new ones go above it
+	proc = open()
+	if e := proc.queue.pull(); e.Key() != "k1" || e.seq != seq {
+		t.Fatal("wrong replayed entry", e, seq)
+	}
+	if next := proc.nextSeq(); next <= seq {
+		t.Fatal("sequence is not above the journal", next, seq)
+	}
+	proc.journalDone(proc.journal.pending["k1"])
+	proc.closeJournal()
+
+	// the highest sequence outlives the answered entries and the compaction
+	open().closeJournal()
+	proc = open()
+	defer proc.closeJournal()
+	if len(proc.journal.pending) != 0 {
+		t.Fatal("entries are left", proc.journal.pending)
+	}
+	if next := proc.nextSeq(); next <= seq {
+		t.Fatal("sequence is not above the journal", next, seq)
+	}
+}
+
+// transport that loses the first response of the entity, it replaces the session on Connect
+type lossyTransport struct {
+	Transport
+	lost atomic.Bool
+}
+
+func (t *lossyTransport) Connect(id int) (chan<- mes.Message, error) {
+	t.Transport.Disconnect(id)
+	return t.Transport.Connect(id)
+}
+
+func (t *lossyTransport) Resp(id int) mes.Message {
+	resp := t.Transport.Resp(id)
+	if t.lost.CompareAndSwap(false, true) {
+		return mes.Message{}
+	}
+	return resp
+}
+
+func TestResendOnce(t *testing.T) {
+	ent := entity.New(procLimit)
+	defer ent.Shutdown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := ent.Watch(ctx, "")
+
+	proc := newProc(1)
+	WaitRespInterval(200 * time.Millisecond)(proc)
+	ReconnectInterval(50 * time.Millisecond)(proc)
+	MaxWaitingConnection(time.Second)(proc)
+	if err := proc.Start(&lossyTransport{Transport: ent}); err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Shutdown()
+
+	proc.Add("k1", "is k1")
+	if err := proc.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s := proc.Stats(); s.Resent == 0 {
+		t.Fatal("expected a resend", s)
+	}
+
+	// the resent write is applied once
+	select {
+	case ev := <-events:
+		if ev.Key != "k1" || ev.Version != 1 {
+			t.Fatal("wrong event", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+	select {
+	case ev := <-events:
+		t.Fatal("applied twice", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// transport that counts the messages sent to the entity
+type countTransport struct {
+	Transport
+	msgs atomic.Int64
+}
+
+func (t *countTransport) Connect(id int) (chan<- mes.Message, error) {
+	ch, err := t.Transport.Connect(id)
+	if err != nil {
+		return nil, err
+	}
+	proxy := make(chan mes.Message)
+	go func() {
+		for m := range proxy {
+			t.msgs.Add(1)
+			ch <- m
+		}
+	}()
+	return proxy, nil
+}
+
+func TestSendBatch(t *testing.T) {
+	ent := entity.New(procLimit)
+	defer ent.Shutdown()
+	tr := &countTransport{Transport: ent}
+
+	proc := newProc(1)
+	MaxMsgSize(1 << 20)(proc)
+	for i := 0; i < 100; i++ {
+		proc.Add(fmt.Sprintf("k%d", i), "is k")
+	}
+	if err := proc.Start(tr); err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Shutdown()
+	if err := proc.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if ent.Len() != 100 {
+		t.Fatal("wrong len", ent.Len())
+	}
+	if s := proc.Stats(); s.Sent != 100 || s.Acked != 100 {
+		t.Fatal("wrong stats", s)
+	}
+	if n := tr.msgs.Load(); n > 10 {
+		t.Fatal("too many messages", n)
+	}
+}
+
+// transport that answers the messages only when it has n of them and in reverse order,
+// the key "bad" fails
+type reverseTransport struct {
+	n    int
+	resp chan mes.Message
+}
+
+func (t *reverseTransport) Connect(id int) (chan<- mes.Message, error) {
+	ch := make(chan mes.Message)
+	t.resp = make(chan mes.Message, 100)
+	go func() {
+		held := make([]mes.Message, 0, t.n)
+		for m := range ch {
+			held = append(held, m)
+			if len(held) < t.n {
+				continue
+			}
+			for i := len(held) - 1; i >= 0; i-- {
+				resp := mes.SuccessMessage()
+				if held[i].Inside.Key == "bad" {
+					resp = mes.FailMessage(ErrVersionMismatch)
+				}
+				t.resp <- resp.WithID(held[i].ID)
+			}
+			held = held[:0]
+		}
+	}()
+	return ch, nil
+}
+
+func (t *reverseTransport) Disconnect(id int) error {
+	return nil
+}
+
+func (t *reverseTransport) Resp(id int) mes.Message {
+	select {
+	case m := <-t.resp:
+		return m
+	case <-time.After(100 * time.Millisecond):
+		return mes.Message{}
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	tr := &reverseTransport{n: 4}
+	proc := newProc(1)
+	// one entry in every message
+	MaxMsgSize(0)(proc)
+	MaxInFlight(4)(proc)
+	WaitRespInterval(time.Second)(proc)
+	for i := 0; i < 7; i++ {
+		proc.Add(fmt.Sprintf("k%d", i), "is k")
+	}
+	proc.Add("bad", "is bad")
+	if err := proc.Start(tr); err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Shutdown()
+
+	// every message is answered only when 4 of them are in flight
+	if err := proc.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s := proc.Stats()
+	if s.Sent != 8 || s.Acked != 7 || s.Failed != 1 || s.Resent != 0 {
+		t.Fatal("wrong stats", s)
+	}
+	dead := proc.DeadLetters()
+	if len(dead) != 1 || dead[0].Key() != "bad" {
+		t.Fatal("wrong dead letters", dead)
+	}
+}
+
+// transport that answers a write only once its data is released
+type holdTransport struct {
+	resp chan mes.Message
+	lk   sync.Mutex
+	held map[string]mes.Message
+}
+
+func newHoldTransport() *holdTransport {
+	return &holdTransport{resp: make(chan mes.Message, 100), held: make(map[string]mes.Message)}
+}
+
+func (t *holdTransport) Connect(id int) (chan<- mes.Message, error) {
+	ch := make(chan mes.Message)
+	go func() {
+		for m := range ch {
+			t.lk.Lock()
+			t.held[m.Inside.Data] = mes.SuccessMessage().WithID(m.ID)
+			t.lk.Unlock()
+		}
+	}()
+	return ch, nil
+}
+
+func (t *holdTransport) Disconnect(id int) error {
+	return nil
+}
+
+func (t *holdTransport) Resp(id int) mes.Message {
+	select {
+	case m := <-t.resp:
+		return m
+	case <-time.After(100 * time.Millisecond):
+		return mes.Message{}
+	}
+}
+
+func (t *holdTransport) has(data string) bool {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	_, ok := t.held[data]
+	return ok
+}
+
+func (t *holdTransport) release(data string) {
+	t.lk.Lock()
+	m := t.held[data]
+	delete(t.held, data)
+	t.lk.Unlock()
+	t.resp <- m
+}
+
+func TestFlushInFlight(t *testing.T) {
+	tr := newHoldTransport()
+	proc := newProc(1)
+	MaxMsgSize(0)(proc)
+	MaxInFlight(2)(proc)
+	WaitRespInterval(10 * time.Second)(proc)
+	if err := proc.Start(tr); err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Shutdown()
+
+	// two writes of the key in flight, the sent wantlist has only the first
+	proc.Add("k1", "first")
+	waitFor(t, func() bool { return tr.has("first") }, "first write is not sent")
+	proc.Add("k1", "second")
+	waitFor(t, func() bool { return tr.has("second") }, "second write is not sent")
+	tr.release("first")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := proc.Flush(ctx); err != context.DeadlineExceeded {
+		t.Fatal("flushed with a write in flight", err)
+	}
+	tr.release("second")
+	if err := proc.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// transport that holds the response to its first message back until the next one is answered,
+// the held response of a write is a Fail
+type staleTransport struct {
+	lk    sync.Mutex
+	first bool
+	held  *mes.Message
+	resp  chan mes.Message
+}
+
+func newStaleTransport() *staleTransport {
+	return &staleTransport{first: true, resp: make(chan mes.Message, 100)}
+}
+
+func (t *staleTransport) Connect(id int) (chan<- mes.Message, error) {
+	ch := make(chan mes.Message)
+	go func() {
+		for m := range ch {
+			t.lk.Lock()
+			resp := mes.SuccessMessage()
+			switch m.Op {
+			case mes.Get:
+				resp = mes.ValueMessage(mes.NewInside(m.Inside.Key, "is "+m.Inside.Key))
+			case mes.Add, mes.Delete:
+				if t.first {
+					resp = mes.FailMessage(ErrVersionMismatch)
+				}
+			}
+			resp = resp.WithID(m.ID)
+
+			if t.first {
+				t.first = false
+				t.held = &resp
+				t.lk.Unlock()
+				continue
+			}
+			if t.held != nil {
+				t.resp <- *t.held
+				t.held = nil
+			}
+			t.lk.Unlock()
+			t.resp <- resp
+		}
+	}()
+	return ch, nil
+}
+
+func (t *staleTransport) Disconnect(id int) error {
+	return nil
+}
+
+func (t *staleTransport) Resp(id int) mes.Message {
+	select {
+	case m := <-t.resp:
+		return m
+	case <-time.After(100 * time.Millisecond):
+		return mes.Message{}
+	}
+}
+
+func TestLateWriteResponse(t *testing.T) {
+	proc := newProc(1)
+	WaitRespInterval(200 * time.Millisecond)(proc)
+	ReconnectInterval(50 * time.Millisecond)(proc)
+	MaxWaitingConnection(time.Second)(proc)
+	if err := proc.Start(newStaleTransport()); err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Shutdown()
+
+	a, err := proc.AddCtx(context.Background(), "k1", "is k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the Fail of the first send comes after its timeout and is not taken for the resend
+	if err := a.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if s := proc.Stats(); s.Acked != 1 || s.Failed != 0 || s.Resent != 1 {
+		t.Fatal("wrong stats", s)
+	}
+	if dead := proc.DeadLetters(); len(dead) != 0 {
+		t.Fatal("wrong dead letters", dead)
+	}
+}
+
+func TestLateRequestResponse(t *testing.T) {
+	proc := newProc(1)
+	WaitRespInterval(200 * time.Millisecond)(proc)
+	if err := proc.Start(newStaleTransport()); err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Shutdown()
+
+	if _, err := proc.Get("k1"); err != ErrTimeoutSend {
+		t.Fatal("expected timeout", err)
+	}
+	// the value of k1 comes first and is dropped
+	in, err := proc.Get("k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Key != "k2" || in.Data != "is k2" {
+		t.Fatal("wrong value", in)
+	}
+}
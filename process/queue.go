@@ -2,6 +2,7 @@ package process
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
 type Queue struct {
@@ -11,6 +12,8 @@ type Queue struct {
 	stop  bool
 	done  chan struct{}
 	out   chan Entry
+	// entries pushed and not processed yet, it is read without lk
+	depth atomic.Int64
 }
 
 func newQueue() *Queue {
@@ -50,9 +53,20 @@ func (q *Queue) Push(e Entry) {
 	q.lk.Lock()
 	defer q.lk.Unlock()
 	q.queue = append(q.queue, e)
+	q.depth.Add(1)
 	q.cond.Broadcast()
 }
 
 func (q *Queue) len() int {
 	return len(q.queue)
 }
+
+// processed is called when a pulled entry has got to the wantlists
+func (q *Queue) processed() {
+	q.depth.Add(-1)
+}
+
+// Len of the queue with the entry being processed, it does not wait for the process that pulls
+func (q *Queue) Len() int {
+	return int(q.depth.Load())
+}
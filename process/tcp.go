@@ -0,0 +1,258 @@
+package process
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	mes "github.com/qwertyqq2/entity/message"
+)
+
+const (
+	dialTimeout = 5 * time.Second
+	respTimeout = 5 * time.Second
+	connBuffer  = 100
+)
+
+var (
+	ErrNotConnected     = errors.New("process is not connected")
+	ErrHandshakeTimeout = errors.New("handshake timeout")
+)
+
+// Transport to an entity served by entity/server.
+// Every process gets its own connection, Connect of a connected process dials again
+type tcpTransport struct {
+	addr  string
+	clock clock.Clock
+
+	lk    sync.Mutex
+	conns map[int]*tcpConn
+	// closed and replaced once the connections change, under lk
+	changed chan struct{}
+}
+
+type tcpConn struct {
+	conn net.Conn
+	out  chan mes.Message
+	in   chan mes.Message
+
+	once sync.Once
+	done chan struct{}
+}
+
+type TCPOption func(*tcpTransport)
+
+// Clock used for the dial, handshake and response timeouts, the real clock by default
+func TCPClock(c clock.Clock) TCPOption {
+	return func(t *tcpTransport) {
+		t.clock = c
+	}
+}
+
+// DialTCP returns a transport to the entity server at addr.
+// Nothing is dialed until a process connects
+func DialTCP(addr string, opts ...TCPOption) Transport {
+	t := &tcpTransport{
+		addr:    addr,
+		clock:   clock.New(),
+		conns:   make(map[int]*tcpConn),
+		changed: make(chan struct{}),
+	}
+	for _, o := range opts {
+		o(t)
+	}
+	return t
+}
+
+func (t *tcpTransport) Connect(id int) (chan<- mes.Message, error) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	if old, ok := t.conns[id]; ok {
+		old.close()
+		delete(t.conns, id)
+		t.notify()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := t.afterFunc(dialTimeout, cancel)
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", t.addr)
+	stop()
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	c, err := t.handshake(conn, id)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	t.conns[id] = c
+	t.notify()
+	go c.writeLoop()
+	go c.readLoop()
+	return c.out, nil
+}
+
+// handshake sends Hello and reads Welcome, the connection is closed if that takes dialTimeout
+func (t *tcpTransport) handshake(conn net.Conn, id int) (*tcpConn, error) {
+	stop := t.afterFunc(dialTimeout, func() { conn.Close() })
+	err := welcome(conn, id)
+	if !stop() {
+		return nil, ErrHandshakeTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &tcpConn{
+		conn: conn,
+		out:  make(chan mes.Message, connBuffer),
+		in:   make(chan mes.Message, connBuffer),
+		done: make(chan struct{}),
+	}, nil
+}
+
+// afterFunc calls fn after d on the clock of the transport unless stop is called first.
+// Stop returns false if fn has been called, it is done by then
+func (t *tcpTransport) afterFunc(d time.Duration, fn func()) (stop func() bool) {
+	timer := t.clock.Timer(d)
+	stopped, fired := make(chan struct{}), make(chan struct{})
+	go func() {
+		select {
+		case <-timer.C:
+			fn()
+			close(fired)
+		case <-stopped:
+		}
+	}()
+	return func() bool {
+		if !timer.Stop() {
+			<-fired
+			return false
+		}
+		close(stopped)
+		return true
+	}
+}
+
+func welcome(conn net.Conn, id int) error {
+	if err := mes.WriteFrame(conn, mes.HelloFrame(id)); err != nil {
+		return err
+	}
+	f, err := mes.ReadFrame(conn)
+	if err != nil {
+		return err
+	}
+	if f.Kind != mes.FrameWelcome {
+		return mes.ErrBadFrame
+	}
+	if f.Err != "" {
+		return errors.New(f.Err)
+	}
+	return nil
+}
+
+func (t *tcpTransport) Disconnect(id int) error {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	c, ok := t.conns[id]
+	if !ok {
+		return ErrNotConnected
+	}
+	c.close()
+	delete(t.conns, id)
+	t.notify()
+	return nil
+}
+
+// notify wakes up the Resp calls waiting for a connection, t.lk must be held
+func (t *tcpTransport) notify() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// Resp waits respTimeout for a response.
+// A broken or missing connection is waited out until the process connects again
+func (t *tcpTransport) Resp(id int) mes.Message {
+	timeout := t.clock.Timer(respTimeout)
+	defer timeout.Stop()
+
+	for {
+		t.lk.Lock()
+		c, ok := t.conns[id]
+		changed := t.changed
+		t.lk.Unlock()
+
+		var (
+			in   <-chan mes.Message
+			done <-chan struct{}
+		)
+		if ok {
+			// responses that came before the connection broke are still given out
+			select {
+			case m := <-c.in:
+				return m
+			default:
+			}
+			select {
+			case <-c.done:
+			default:
+				in, done = c.in, c.done
+			}
+		}
+
+		select {
+		case m := <-in:
+			return m
+		case <-done:
+		case <-changed:
+		case <-timeout.C:
+			return mes.Message{}
+		}
+	}
+}
+
+func (c *tcpConn) writeLoop() {
+	defer c.close()
+	for {
+		select {
+		case m := <-c.out:
+			if err := mes.WriteFrame(c.conn, mes.MessageFrame(m)); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *tcpConn) readLoop() {
+	defer c.close()
+	for {
+		f, err := mes.ReadFrame(c.conn)
+		if err != nil {
+			return
+		}
+		if f.Kind != mes.FrameMessage {
+			return
+		}
+		select {
+		case c.in <- f.Msg:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// close is safe to call many times, the process finds out by a missing response
+func (c *tcpConn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
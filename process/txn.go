@@ -0,0 +1,50 @@
+package process
+
+import (
+	"time"
+
+	mes "github.com/qwertyqq2/entity/message"
+)
+
+// Collects operations that the entity applies all together or not at all
+type Tx interface {
+	Add(key, data string)
+
+	AddWithTTL(key, data string, ttl time.Duration)
+
+	Delete(key string)
+
+	// Fails the whole txn if the key does not have the expected version
+	CompareAndSwap(key string, expectedVersion uint64, data string)
+}
+
+type tx struct {
+	ops []mes.Message
+}
+
+func (t *tx) Add(key, data string) {
+	t.ops = append(t.ops, mes.AddMessage(key, data))
+}
+
+func (t *tx) AddWithTTL(key, data string, ttl time.Duration) {
+	t.ops = append(t.ops, mes.AddWithTTLMessage(key, data, ttl))
+}
+
+func (t *tx) Delete(key string) {
+	t.ops = append(t.ops, mes.DeleteMessage(key))
+}
+
+func (t *tx) CompareAndSwap(key string, expectedVersion uint64, data string) {
+	t.ops = append(t.ops, mes.CASMessage(key, data, expectedVersion))
+}
+
+func (p *impl) Txn(fn func(tx Tx)) error {
+	t := &tx{}
+	fn(t)
+	if len(t.ops) == 0 {
+		return nil
+	}
+
+	_, err := p.request(mes.TxnMessage(t.ops...))
+	return err
+}
@@ -3,6 +3,7 @@ package process
 import (
 	"fmt"
 	"sort"
+	"time"
 
 	mes "github.com/qwertyqq2/entity/message"
 )
@@ -16,7 +17,37 @@ type Entry struct {
 	key       string
 	op        mes.Op
 	data      mes.Inside
+	ttl       time.Duration
 	undefined bool
+	// error of the entity for a dead letter
+	err error
+	// id in the journal, 0 without one
+	jid uint64
+	// sequence number of the write, kept when it is resent
+	seq uint64
+	// resolved with the answer of the entity
+	acks []*ack
+}
+
+func (e Entry) Key() string {
+	return e.data.Key
+}
+
+func (e Entry) Op() mes.Op {
+	return e.op
+}
+
+func (e Entry) Data() string {
+	return e.data.Data
+}
+
+func (e Entry) TTL() time.Duration {
+	return e.ttl
+}
+
+// Err is the error of the entity for a dead letter
+func (e Entry) Err() error {
+	return e.err
 }
 
 func (e Entry) Empty() bool {
@@ -25,13 +56,40 @@ func (e Entry) Empty() bool {
 		return false
 	}
 	switch e.op {
-	case mes.Add, mes.Get, mes.Has, mes.Delete, mes.Fail, mes.Success, mes.Ping:
+	case mes.Add, mes.Get, mes.Has, mes.Delete, mes.Fail, mes.Success, mes.Ping, mes.CAS, mes.Txn:
 		return false
 	default:
 		return true
 	}
 }
 
+func (e Entry) message() mes.Message {
+	return mes.Message{
+		Inside: e.data,
+		Op:     e.op,
+		TTL:    e.ttl,
+	}
+}
+
+func (e Entry) resolve(err error) {
+	for _, a := range e.acks {
+		a.resolve(err)
+	}
+}
+
+// canceled is true if the entry was added with contexts that are all done
+func (e Entry) canceled() bool {
+	if len(e.acks) == 0 {
+		return false
+	}
+	for _, a := range e.acks {
+		if !a.canceled() {
+			return false
+		}
+	}
+	return true
+}
+
 func (e Entry) String() string {
 	return fmt.Sprintf("op: %d, key: %s, data: %s\n", e.op, e.data.Key, e.data.Data)
 }
@@ -53,16 +111,36 @@ func (w *Wantlist) Len() int {
 }
 
 func (w *Wantlist) Add(key string, op mes.Op, data mes.Inside) bool {
-	e, ok := w.set[key]
+	return w.AddEntry(Entry{key: key, op: op, data: data})
+}
 
-	if ok && e.data.Key != "" {
+// AddEntry keeps the whole entry, the key is taken from its data.
+// An entry with the key is kept, it takes the acks of e
+func (w *Wantlist) AddEntry(e Entry) bool {
+	key := e.data.Key
+	if old, ok := w.set[key]; ok && old.data.Key != "" {
+		if len(e.acks) > 0 {
+			old.acks = mergeAcks(old.acks, e.acks)
+			w.put(key, old)
+		}
 		return false
 	}
 
-	w.put(key, Entry{key: key, op: op, data: data})
+	e.key = key
+	w.put(key, e)
 	return true
 }
 
+// Replace puts e in place of the entry with the key, e takes its acks
+func (w *Wantlist) Replace(e Entry) {
+	key := e.data.Key
+	if old, ok := w.set[key]; ok {
+		e.acks = mergeAcks(old.acks, e.acks)
+	}
+	e.key = key
+	w.put(key, e)
+}
+
 func (w *Wantlist) Remove(key string) bool {
 	if _, ok := w.set[key]; !ok {
 		return false
@@ -71,6 +149,17 @@ func (w *Wantlist) Remove(key string) bool {
 	return true
 }
 
+// RemoveEntry removes the entry of the key only if it is the same write as e,
+// so the answer to an old write of the key does not drop a newer one
+func (w *Wantlist) RemoveEntry(e Entry) bool {
+	old, ok := w.set[e.data.Key]
+	if !ok || old.seq != e.seq {
+		return false
+	}
+	w.delete(e.data.Key)
+	return true
+}
+
 func (w *Wantlist) Contains(key string) (Entry, bool) {
 	e, ok := w.set[key]
 	return e, ok
@@ -92,7 +181,7 @@ func (w *Wantlist) Entries() []Entry {
 func (w *Wantlist) Absorf(other *Wantlist) {
 	w.cache = nil
 	for _, e := range other.Entries() {
-		w.Add(e.key, e.op, e.data)
+		w.AddEntry(e)
 	}
 }
 